@@ -47,7 +47,9 @@ else
   }
 
   compile_for_arch() {
-    compile_openssl "$1"
+    if [ -z "$WITHOUT_OPENSSL" ]; then
+      compile_openssl "$1"
+    fi
     if [ "$1" = "x86_64" ]; then
       CFN="x86_64-linux-android21-clang"
     elif [ "$1" = "x86" ]; then
@@ -69,12 +71,27 @@ else
     export CXX="$NDK_BIN_PATH/$CFN++"
     export CGO_ENABLED=1
     export GOOS=android
-    export CGO_CFLAGS="-I ${PWD}/include/$1"
-    export CGO_LDFLAGS="-Wl,-soname=libgocryptfs.so -L${PWD}/lib/$1"
-    go build -o "build/$1/libgocryptfs.so" -buildmode=c-shared
+    if [ -z "$WITHOUT_OPENSSL" ]; then
+      export CGO_CFLAGS="-I ${PWD}/include/$1"
+      export CGO_LDFLAGS="-Wl,-soname=libgocryptfs.so -L${PWD}/lib/$1"
+      TAGS=""
+    else
+      # cgo is still needed for the C API, but not for the crypto
+      export CGO_LDFLAGS="-Wl,-soname=libgocryptfs.so"
+      TAGS="without_openssl"
+    fi
+    go build -o "build/$1/libgocryptfs.so" -buildmode=c-shared -tags "$TAGS" -ldflags "-X main.GitVersion=$GITVERSION"
   }
 
+  # --without-openssl: don't build OpenSSL, use the Go implementations only
+  WITHOUT_OPENSSL=""
+  if [ "$1" = "--without-openssl" ]; then
+    WITHOUT_OPENSSL=1
+    shift
+  fi
+
   cd "$(dirname "$0")"
+  GITVERSION=$(git describe --tags --dirty --always 2>/dev/null || echo "unknown")
   if [ "$#" -eq 1 ]; then
     compile_for_arch "$1"
   else
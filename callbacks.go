@@ -0,0 +1,161 @@
+package main
+
+// C trampolines to call the function pointers given by the host.
+// They can't live in a file with //export directives, because the preamble of
+// such files may only contain declarations.
+
+/*
+#include <stdlib.h>
+#include <string.h>
+
+typedef void (*gcf_lock_callback)(int volumeID);
+
+static void call_lock_callback(void* callback, int volumeID) {
+	((gcf_lock_callback)callback)(volumeID);
+}
+
+typedef int (*gcf_progress_callback)(int volumeID, unsigned long long done, unsigned long long total);
+
+static int call_progress_callback(void* callback, int volumeID, unsigned long long done, unsigned long long total) {
+	return ((gcf_progress_callback)callback)(volumeID, done, total);
+}
+
+typedef int (*gcf_walk_callback)(int volumeID, const char* path, unsigned int mode, unsigned long long size, unsigned long long mtime);
+
+static int call_walk_callback(void* callback, int volumeID, const char* path, unsigned int mode, unsigned long long size, unsigned long long mtime) {
+	return ((gcf_walk_callback)callback)(volumeID, path, mode, size, mtime);
+}
+
+typedef void (*gcf_unlock_callback)(int requestID, int result, const unsigned char* scryptHash, int scryptHashLen);
+
+static void call_unlock_callback(void* callback, int requestID, int result, const unsigned char* scryptHash, int scryptHashLen) {
+	((gcf_unlock_callback)callback)(requestID, result, scryptHash, scryptHashLen);
+}
+
+typedef void (*gcf_unlock_progress_callback)(int requestID, int phase);
+
+static void call_unlock_progress_callback(void* callback, int requestID, int phase) {
+	((gcf_unlock_progress_callback)callback)(requestID, phase);
+}
+*/
+import "C"
+
+import (
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// hostCallThreads records the OS threads currently running a host callback
+// on behalf of an operation on a volume. A host that calls back into the
+// library from such a callback runs on the same thread, which lets
+// volume.close detect that it would wait for the operation it is called from.
+var hostCallThreads struct {
+	sync.Mutex
+	// Number of nested host callbacks per volume and thread
+	m map[hostCallThread]int
+}
+
+type hostCallThread struct {
+	volumeID int
+	tid      int
+}
+
+// hostCall runs "f", which calls into the host during an operation on
+// "volumeID".
+func hostCall(volumeID int, f func()) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	key := hostCallThread{volumeID, syscall.Gettid()}
+	hostCallThreads.Lock()
+	if hostCallThreads.m == nil {
+		hostCallThreads.m = make(map[hostCallThread]int)
+	}
+	hostCallThreads.m[key]++
+	hostCallThreads.Unlock()
+	defer func() {
+		hostCallThreads.Lock()
+		if hostCallThreads.m[key]--; hostCallThreads.m[key] == 0 {
+			delete(hostCallThreads.m, key)
+		}
+		hostCallThreads.Unlock()
+	}()
+	f()
+}
+
+// inHostCall returns true if the current thread is running a host callback
+// of an operation on "volumeID".
+func inHostCall(volumeID int) bool {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	hostCallThreads.Lock()
+	defer hostCallThreads.Unlock()
+	return hostCallThreads.m[hostCallThread{volumeID, syscall.Gettid()}] > 0
+}
+
+// callLockCallback calls a "void (*)(int volumeID)" host function.
+func callLockCallback(callback unsafe.Pointer, volumeID int) {
+	if callback == nil {
+		return
+	}
+	C.call_lock_callback(callback, C.int(volumeID))
+}
+
+// progressFunc reports the progress of a long operation. The unit of "done"
+// and "total" depends on the operation. The operation is aborted if it
+// returns false.
+type progressFunc func(done, total uint64) bool
+
+// hostProgress wraps an "int (*)(int volumeID, unsigned long long done,
+// unsigned long long total)" host function, which returns non-zero to abort.
+// A nil callback never aborts.
+func hostProgress(callback unsafe.Pointer, volumeID int) progressFunc {
+	return func(done, total uint64) bool {
+		if callback == nil {
+			return true
+		}
+		var ret C.int
+		hostCall(volumeID, func() {
+			ret = C.call_progress_callback(callback, C.int(volumeID), C.ulonglong(done), C.ulonglong(total))
+		})
+		return ret == 0
+	}
+}
+
+// callWalkCallback calls an "int (*)(int volumeID, const char* path,
+// unsigned int mode, unsigned long long size, unsigned long long mtime)" host
+// function. Returns false if the host wants to stop.
+func callWalkCallback(callback unsafe.Pointer, volumeID int, path string, mode uint32, size, mtime uint64) bool {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	var ret C.int
+	hostCall(volumeID, func() {
+		ret = C.call_walk_callback(callback, C.int(volumeID), cPath, C.uint(mode), C.ulonglong(size), C.ulonglong(mtime))
+	})
+	return ret == 0
+}
+
+// callUnlockCallback calls a "void (*)(int requestID, int result, const
+// unsigned char* scryptHash, int scryptHashLen)" host function. "scryptHash"
+// may be empty.
+func callUnlockCallback(callback unsafe.Pointer, requestID int, result int, scryptHash []byte) {
+	var p *C.uchar
+	if len(scryptHash) > 0 {
+		p = (*C.uchar)(C.CBytes(scryptHash))
+		defer func() {
+			C.memset(unsafe.Pointer(p), 0, C.size_t(len(scryptHash)))
+			C.free(unsafe.Pointer(p))
+		}()
+	}
+	C.call_unlock_callback(callback, C.int(requestID), C.int(result), p, C.int(len(scryptHash)))
+}
+
+// callUnlockProgressCallback calls a "void (*)(int requestID, int phase)"
+// host function. A nil callback is ignored.
+func callUnlockProgressCallback(callback unsafe.Pointer, requestID int, phase int) {
+	if callback == nil {
+		return
+	}
+	C.call_unlock_progress_callback(callback, C.int(requestID), C.int(phase))
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"C"
+	"fmt"
+	"os"
+	"sync/atomic"
 	"syscall"
+
 	"golang.org/x/sys/unix"
 
 	"libgocryptfs/v2/internal/nametransform"
@@ -11,51 +15,110 @@ import (
 
 //export gcf_get_attrs
 func gcf_get_attrs(sessionID int, relPath string) (uint32, uint64, uint64, bool) {
-	value, ok := OpenedVolumes.Load(sessionID)
+	volume, ok := acquireVolume(sessionID)
 	if !ok {
 		return 0, 0, 0, false
 	}
-	volume := value.(*Volume)
+	defer volume.release()
+	return volume.getAttrs(relPath)
+}
+
+// getAttrs returns the mode, the plaintext size and the modification time
+// of "relPath".
+func (volume *Volume) getAttrs(relPath string) (uint32, uint64, uint64, bool) {
+	mode, size, mtime, err := volume.stat(relPath)
+	return mode, size, mtime, err == nil
+}
+
+// stat is like getAttrs but returns the error.
+func (volume *Volume) stat(relPath string) (mode uint32, size uint64, mtime uint64, err error) {
 	dirfd, cName, err := volume.prepareAtSyscall(relPath)
 	if err != nil {
-		return 0, 0, 0, false
+		return 0, 0, 0, err
 	}
 	defer syscall.Close(dirfd)
 
 	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
 	if err != nil {
-		return 0, 0, 0, false
+		return 0, 0, 0, err
 	}
 
 	// Translate ciphertext size to plaintext size
-	size := volume.translateSize(dirfd, cName, st)
+	size = volume.translateSize(dirfd, cName, st)
 
-	return st.Mode, size, uint64(st.Mtim.Sec), true
+	return st.Mode, size, uint64(st.Mtim.Sec), nil
 }
 
-// libgocryptfs: using Renameat instead of Renameat2 to support older kernels
 //export gcf_rename
 func gcf_rename(sessionID int, oldPath string, newPath string) bool {
-	value, ok := OpenedVolumes.Load(sessionID)
+	volume, ok := acquireVolume(sessionID)
 	if !ok {
 		return false
 	}
-	volume := value.(*Volume)
+	defer volume.release()
+	return errToBool(volume.rename(oldPath, newPath, 0))
+}
+
+// gcf_rename_flags renames "oldPath" to "newPath" like renameat2(2). "flags"
+// can be 0, RENAME_NOREPLACE (1) or RENAME_EXCHANGE (2):
+//
+// With RENAME_NOREPLACE, the rename fails with EEXIST if "newPath" exists.
+//
+// With RENAME_EXCHANGE, "oldPath" and "newPath" are atomically swapped. Both
+// must exist.
+//
+// On kernels or filesystems without renameat2 support, both flags are
+// emulated. The emulation is not atomic: RENAME_NOREPLACE checks for the
+// target before renaming, RENAME_EXCHANGE goes through a temporary name
+// starting with "gocryptfs.exchange.", which is reserved in every directory.
+//
+// Returns 0 on success or the errno value describing the error.
+//
+//export gcf_rename_flags
+func gcf_rename_flags(sessionID int, oldPath string, newPath string, flags uint32) int {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return int(syscall.EBADF)
+	}
+	defer volume.release()
+	return errToErrno(volume.rename(oldPath, newPath, uint(flags)))
+}
+
+// rename implements gcf_rename and gcf_rename_flags.
+func (volume *Volume) rename(oldPath string, newPath string, flags uint) (err error) {
+	if flags&^(syscallcompat.RENAME_NOREPLACE|syscallcompat.RENAME_EXCHANGE) != 0 ||
+		flags == syscallcompat.RENAME_NOREPLACE|syscallcompat.RENAME_EXCHANGE {
+		return syscall.EINVAL
+	}
 	dirfd, cName, err := volume.prepareAtSyscall(oldPath)
 	if err != nil {
-		return false
+		return err
 	}
 	defer syscall.Close(dirfd)
 
 	dirfd2, cName2, err := volume.prepareAtSyscall(newPath)
 	if err != nil {
-		return false
+		return err
 	}
 	defer syscall.Close(dirfd2)
 
+	// Cached directory fds are keyed by plaintext path and may point to the
+	// wrong directory after the rename
+	defer volume.dirCache.Clear()
+	defer func() {
+		if err == nil {
+			volume.indexRename(oldPath, newPath, flags&syscallcompat.RENAME_EXCHANGE != 0)
+		}
+	}()
+
 	// Easy case.
 	if volume.plainTextNames {
-		return errToBool(syscallcompat.Renameat(dirfd, cName, dirfd2, cName2))
+		return renameat2(dirfd, cName, dirfd2, cName2, flags)
+	}
+	// Exchanged entries keep their names, so the .name files stay valid on
+	// both sides.
+	if flags&syscallcompat.RENAME_EXCHANGE != 0 {
+		return renameat2(dirfd, cName, dirfd2, cName2, flags)
 	}
 	// Long destination file name: create .name file
 	nameFileAlreadyThere := false
@@ -67,19 +130,19 @@ func gcf_rename(sessionID int, oldPath string, newPath string) bool {
 		if err == syscall.EEXIST {
 			nameFileAlreadyThere = true
 		} else if err != nil {
-			return false
+			return err
 		}
 	}
 	// Actual rename
-	err = syscallcompat.Renameat(dirfd, cName, dirfd2, cName2)
-	if err == syscall.ENOTEMPTY || err == syscall.EEXIST {
+	err = renameat2(dirfd, cName, dirfd2, cName2, flags)
+	if flags&syscallcompat.RENAME_NOREPLACE == 0 && (err == syscall.ENOTEMPTY || err == syscall.EEXIST) {
 		// If an empty directory is overwritten we will always get an error as
 		// the "empty" directory will still contain gocryptfs.diriv.
 		// Interestingly, ext4 returns ENOTEMPTY while xfs returns EEXIST.
 		// We handle that by trying to fs.Rmdir() the target directory and trying
 		// again.
-		if gcf_rmdir(sessionID, newPath) {
-			err = syscallcompat.Renameat(dirfd, cName, dirfd2, cName2)
+		if volume.rmdir(newPath) {
+			err = renameat2(dirfd, cName, dirfd2, cName2, flags)
 		}
 	}
 	if err != nil {
@@ -87,10 +150,93 @@ func gcf_rename(sessionID int, oldPath string, newPath string) bool {
 			// Roll back .name creation unless the .name file was already there
 			nametransform.DeleteLongNameAt(dirfd2, cName2)
 		}
-		return false
+		return err
 	}
 	if nametransform.IsLongContent(cName) {
 		nametransform.DeleteLongNameAt(dirfd, cName)
 	}
-	return true
+	return nil
+}
+
+// renameat2 calls Renameat2, or plain Renameat if "flags" is 0 to support
+// older kernels. If the kernel or the filesystem does not support
+// Renameat2, the flags are emulated (non-atomically).
+func renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) error {
+	if flags == 0 {
+		return syscallcompat.Renameat(olddirfd, oldpath, newdirfd, newpath)
+	}
+	err := syscallcompat.Renameat2(olddirfd, oldpath, newdirfd, newpath, flags)
+	if err == syscall.EINVAL && renameFlagsSupported(newdirfd, flags) {
+		// A real EINVAL, like moving a directory into itself
+		return err
+	}
+	if err != syscall.ENOSYS && err != syscall.EINVAL {
+		return err
+	}
+	return emulateRenameat2(olddirfd, oldpath, newdirfd, newpath, flags)
+}
+
+// exchangeSeq makes the temporary names of one process unique.
+var exchangeSeq atomic.Uint64
+
+// exchangeTmpName returns a new temporary name for the RENAME_EXCHANGE
+// emulation, which can never be the encryption of a plaintext name.
+func exchangeTmpName() string {
+	return fmt.Sprintf("%s%d.%d", exchangeTmpPrefix, os.Getpid(), exchangeSeq.Add(1))
+}
+
+// renameFlagsSupported tells if the filesystem of "dirfd" supports the
+// renameat2 "flags", by trying them on two scratch files. EINVAL does not
+// tell an unsupported flag from invalid arguments otherwise.
+func renameFlagsSupported(dirfd int, flags uint) bool {
+	a, b := exchangeTmpName(), exchangeTmpName()
+	fd, err := syscallcompat.Openat(dirfd, a, syscall.O_CREAT|syscall.O_EXCL|syscall.O_WRONLY, 0600)
+	if err != nil {
+		return false
+	}
+	syscall.Close(fd)
+	defer syscallcompat.Unlinkat(dirfd, a, 0)
+	if flags&syscallcompat.RENAME_EXCHANGE != 0 {
+		fd, err = syscallcompat.Openat(dirfd, b, syscall.O_CREAT|syscall.O_EXCL|syscall.O_WRONLY, 0600)
+		if err != nil {
+			return false
+		}
+		syscall.Close(fd)
+	}
+	defer syscallcompat.Unlinkat(dirfd, b, 0)
+	return syscallcompat.Renameat2(dirfd, a, dirfd, b, flags) != syscall.EINVAL
+}
+
+// emulateRenameat2 implements RENAME_NOREPLACE and RENAME_EXCHANGE with plain
+// Renameat calls.
+func emulateRenameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) error {
+	if flags&syscallcompat.RENAME_NOREPLACE != 0 {
+		var st unix.Stat_t
+		err := syscallcompat.Fstatat(newdirfd, newpath, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == nil {
+			return syscall.EEXIST
+		} else if err != syscall.ENOENT {
+			return err
+		}
+		return syscallcompat.Renameat(olddirfd, oldpath, newdirfd, newpath)
+	}
+	// RENAME_EXCHANGE: move the target out of the way under a name that can
+	// never be the encryption of a plaintext name
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(olddirfd, oldpath, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return err
+	}
+	tmpName := exchangeTmpName()
+	err = syscallcompat.Renameat(newdirfd, newpath, newdirfd, tmpName)
+	if err != nil {
+		return err
+	}
+	err = syscallcompat.Renameat(olddirfd, oldpath, newdirfd, newpath)
+	if err != nil {
+		// Put the target back
+		syscallcompat.Renameat(newdirfd, tmpName, newdirfd, newpath)
+		return err
+	}
+	return syscallcompat.Renameat(newdirfd, tmpName, olddirfd, oldpath)
 }
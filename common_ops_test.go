@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"libgocryptfs/v2/internal/syscallcompat"
+)
+
+// renameFlagsTest runs the gcf_rename_flags checks on "volumeID".
+func renameFlagsTest(t *testing.T, volumeID int) {
+	long := "/" + strings.Repeat("l", 200)
+	writeTestFile(t, volumeID, "/a", []byte("a"))
+	writeTestFile(t, volumeID, long, []byte("long"))
+
+	if errno := gcf_rename_flags(volumeID, "/a", long, syscallcompat.RENAME_NOREPLACE); errno != int(syscall.EEXIST) {
+		t.Errorf("RENAME_NOREPLACE onto an existing file: %d", errno)
+	}
+	if errno := gcf_rename_flags(volumeID, "/a", long, syscallcompat.RENAME_EXCHANGE); errno != 0 {
+		t.Fatalf("RENAME_EXCHANGE: %d", errno)
+	}
+	if string(readTestFile(t, volumeID, "/a", 10)) != "long" || string(readTestFile(t, volumeID, long, 10)) != "a" {
+		t.Error("entries not exchanged")
+	}
+	if errno := gcf_rename_flags(volumeID, "/a", "/b", syscallcompat.RENAME_EXCHANGE); errno != int(syscall.ENOENT) {
+		t.Errorf("RENAME_EXCHANGE with a missing target: %d", errno)
+	}
+	if errno := gcf_rename_flags(volumeID, long, "/b", syscallcompat.RENAME_NOREPLACE); errno != 0 {
+		t.Fatalf("RENAME_NOREPLACE: %d", errno)
+	}
+	if string(readTestFile(t, volumeID, "/b", 10)) != "a" {
+		t.Error("renamed file differs")
+	}
+	if errno := gcf_rename_flags(volumeID, "/a", "/b", 3); errno != int(syscall.EINVAL) {
+		t.Errorf("both flags: %d", errno)
+	}
+
+	// A real EINVAL is not emulated
+	gcf_mkdir(volumeID, "/d", 0700)
+	gcf_mkdir(volumeID, "/d/sub", 0700)
+	if errno := gcf_rename_flags(volumeID, "/d", "/d/sub/d", syscallcompat.RENAME_NOREPLACE); errno != int(syscall.EINVAL) {
+		t.Errorf("directory into itself: %d", errno)
+	}
+	if errno := gcf_rename_flags(volumeID, "/d", "/d/sub", syscallcompat.RENAME_EXCHANGE); errno != int(syscall.EINVAL) {
+		t.Errorf("directory exchanged with its child: %d", errno)
+	}
+	if _, _, _, ok := gcf_get_attrs(volumeID, "/d/sub"); !ok {
+		t.Error("failed exchange moved the child")
+	}
+	noTmpNames(t, volumeID, "/")
+	noTmpNames(t, volumeID, "/d")
+}
+
+// noTmpNames checks that no temporary exchange name is left in "dir".
+func noTmpNames(t *testing.T, volumeID int, dir string) {
+	t.Helper()
+	parentfd, cName, err := getVolume(t, volumeID).prepareAtSyscallMyself(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(parentfd)
+	dirfd, err := syscallcompat.Openat(parentfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	entries, err := syscallcompat.Getdents(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if isExchangeTmpName(e.Name) {
+			t.Errorf("%q left in %q", e.Name, dir)
+		}
+	}
+}
+
+func TestRenameFlags(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	renameFlagsTest(t, volumeID)
+}
+
+func TestRenameFlagsPlaintextNames(t *testing.T) {
+	volumeID := openTestVolume(t, createTestVolume(t, true))
+	renameFlagsTest(t, volumeID)
+	// The temporary names of the emulation are reserved in every directory
+	for _, path := range []string{"/gocryptfs.exchange.1.2", "/d/gocryptfs.exchange.1.2"} {
+		if handleID := gcf_open_write_mode(volumeID, path, 0600); handleID >= 0 {
+			t.Errorf("created %q", path)
+		}
+	}
+}
+
+// The emulation used where renameat2 is not supported.
+func TestEmulateRenameat2(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	writeTestFile(t, volumeID, "/a", []byte("a"))
+	gcf_mkdir(volumeID, "/d", 0700)
+	writeTestFile(t, volumeID, "/d/b", []byte("b"))
+	volume := getVolume(t, volumeID)
+	dirfd, cName, _ := volume.prepareAtSyscall("/a")
+	defer syscall.Close(dirfd)
+	dirfd2, cName2, _ := volume.prepareAtSyscall("/d/b")
+	defer syscall.Close(dirfd2)
+
+	if err := emulateRenameat2(dirfd, cName, dirfd2, cName2, syscallcompat.RENAME_NOREPLACE); err != syscall.EEXIST {
+		t.Errorf("RENAME_NOREPLACE onto an existing file: %v", err)
+	}
+	if err := emulateRenameat2(dirfd, cName, dirfd2, cName2, syscallcompat.RENAME_EXCHANGE); err != nil {
+		t.Fatalf("RENAME_EXCHANGE: %v", err)
+	}
+	volume.dirCache.Clear()
+	if string(readTestFile(t, volumeID, "/a", 10)) != "b" || string(readTestFile(t, volumeID, "/d/b", 10)) != "a" {
+		t.Error("entries not exchanged")
+	}
+	noTmpNames(t, volumeID, "/d")
+	if err := emulateRenameat2(dirfd, "missing", dirfd2, cName2, syscallcompat.RENAME_EXCHANGE); err != syscall.ENOENT {
+		t.Errorf("RENAME_EXCHANGE from a missing file: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"C"
+	"path/filepath"
+
+	"libgocryptfs/v2/internal/configfile"
+)
+
+// gcf_check_config tells if the config file of the volume in "rootCipherDir"
+// can be loaded. Returns 0 if it can, 1 if it is missing or corrupted but
+// the backup copy (gocryptfs.conf.bak) is usable and can be restored with
+// gcf_restore_config, and -1 if neither can be loaded.
+//
+//export gcf_check_config
+func gcf_check_config(rootCipherDir string) int {
+	confPath := filepath.Join(rootCipherDir, configfile.ConfDefaultName)
+	if _, err := configfile.Load(confPath); err == nil {
+		return 0
+	}
+	if _, err := configfile.LoadBackup(confPath); err == nil {
+		return 1
+	}
+	return -1
+}
+
+// gcf_restore_config replaces the config file of the volume in
+// "rootCipherDir" with its backup copy. The backup must unlock with
+// "password", or "givenScryptHash" if not empty.
+//
+// Returns the same codes as gcf_verify_password.
+//
+//export gcf_restore_config
+func gcf_restore_config(rootCipherDir string, password, givenScryptHash []byte) int {
+	defer wipe(password)
+	if rekeyPending(rootCipherDir) {
+		return -1
+	}
+	cf, err := configfile.LoadBackup(filepath.Join(rootCipherDir, configfile.ConfDefaultName))
+	if err != nil {
+		return -1
+	}
+	return writeVerifiedConfig(cf, password, givenScryptHash)
+}
+
+// gcf_export_config returns the content of the config file of the volume in
+// "rootCipherDir", for off-device backup. The master key in it is encrypted
+// with the password. Returns NULL if the config file can't be loaded. The
+// host must free the returned string.
+//
+//export gcf_export_config
+func gcf_export_config(rootCipherDir string) *C.char {
+	cf, err := configfile.Load(filepath.Join(rootCipherDir, configfile.ConfDefaultName))
+	if err != nil {
+		return nil
+	}
+	js, err := cf.Marshal()
+	if err != nil {
+		return nil
+	}
+	return C.CString(string(js))
+}
+
+// gcf_import_config writes "config", returned by gcf_export_config, as the
+// config file of the volume in "rootCipherDir", replacing the current one and
+// its backup. "config" must unlock with "password", or "givenScryptHash" if
+// not empty.
+//
+// Returns the same codes as gcf_verify_password.
+//
+//export gcf_import_config
+func gcf_import_config(rootCipherDir string, config string, password, givenScryptHash []byte) int {
+	defer wipe(password)
+	if rekeyPending(rootCipherDir) {
+		return -1
+	}
+	cf, err := configfile.Parse([]byte(config), filepath.Join(rootCipherDir, configfile.ConfDefaultName))
+	if err != nil {
+		return -1
+	}
+	return writeVerifiedConfig(cf, password, givenScryptHash)
+}
+
+// writeVerifiedConfig writes "cf" and its backup if it unlocks with
+// "password" or "givenScryptHash".
+func writeVerifiedConfig(cf *configfile.ConfFile, password, givenScryptHash []byte) int {
+	masterkey, err := cf.GetMasterkey(password, givenScryptHash, nil)
+	if err != nil {
+		return unlockErrCode(err)
+	}
+	masterkey.Destroy()
+	if cf.WriteFile() != nil {
+		return -1
+	}
+	return 0
+}
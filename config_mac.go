@@ -0,0 +1,40 @@
+package main
+
+import (
+	"C"
+	"path/filepath"
+
+	"libgocryptfs/v2/internal/configfile"
+)
+
+// gcf_migrate_config_mac makes the config file MAC of the volume in
+// "rootCipherDir" mandatory. It must unlock with "password", or
+// "givenScryptHash" if not empty, which stays valid.
+//
+// Config files written by gocryptfs or older versions have no MAC, and
+// gcf_init accepts config files without MAC as long as they have not been
+// migrated. Afterwards, a missing MAC is reported as tampering (-4). Migrated
+// volumes can't be mounted by gocryptfs anymore. Volumes created by
+// gcf_create_volume require their MAC from the start, migrating them or an
+// already migrated volume does nothing.
+//
+// Returns the same codes as gcf_verify_password.
+//
+//export gcf_migrate_config_mac
+func gcf_migrate_config_mac(rootCipherDir string, password, givenScryptHash []byte) int {
+	defer wipe(password)
+	if rekeyPending(rootCipherDir) {
+		return -1
+	}
+	cf, err := configfile.Load(filepath.Join(rootCipherDir, configfile.ConfDefaultName))
+	if err != nil {
+		return -1
+	}
+	if err = cf.RequireMAC(password, givenScryptHash); err != nil {
+		return unlockErrCode(err)
+	}
+	if cf.WriteFile() != nil {
+		return -1
+	}
+	return 0
+}
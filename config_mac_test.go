@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"libgocryptfs/v2/internal/configfile"
+)
+
+// New volumes refuse to open without their config MAC.
+func TestConfigMACStripped(t *testing.T) {
+	dir := createTestVolume(t, false)
+	if code := gcf_migrate_config_mac(dir, []byte(testPassword), nil); code != 0 {
+		t.Fatalf("gcf_migrate_config_mac returned %d", code)
+	}
+	filename := filepath.Join(dir, configfile.ConfDefaultName)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conf map[string]interface{}
+	if err = json.Unmarshal(data, &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf["ConfigMAC"] == nil {
+		t.Fatal("new config has no MAC")
+	}
+	delete(conf, "ConfigMAC")
+	data, _ = json.Marshal(conf)
+	if err = os.WriteFile(filename, data, 0400); err != nil {
+		t.Fatal(err)
+	}
+	if code := gcf_init(dir, []byte(testPassword), nil, nil); code != -4 {
+		t.Errorf("gcf_init returned %d", code)
+	}
+	if code := gcf_verify_password(dir, []byte("wrong"), nil, nil); code != -2 {
+		t.Errorf("wrong password: %d", code)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"C"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"libgocryptfs/v2/internal/contentenc"
+	"libgocryptfs/v2/internal/nametransform"
+	"libgocryptfs/v2/internal/syscallcompat"
+)
+
+// copier copies files and directory trees from one volume to another (or to
+// the same volume). File contents are decrypted block by block and
+// re-encrypted under a new file ID, without going through the host.
+//
+// The caller must hold an in-flight operation on both volumes.
+type copier struct {
+	src      *Volume
+	dst      *Volume
+	progress progressFunc
+	// done and total are in plaintext bytes of regular files
+	done  uint64
+	total uint64
+}
+
+// treeSize returns the plaintext size of the regular files below "relPath".
+func (volume *Volume) treeSize(relPath string) (uint64, error) {
+	mode, size, _, err := volume.stat(relPath)
+	if err != nil {
+		return 0, err
+	}
+	if isRegular(mode) {
+		return size, nil
+	}
+	if mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return 0, nil
+	}
+	entries, err := volume.listDir(relPath, false)
+	if err != nil {
+		return 0, err
+	}
+	var total uint64
+	for _, e := range entries {
+		if e.mode&syscall.S_IFMT == syscall.S_IFREG || e.mode&syscall.S_IFMT == syscall.S_IFDIR {
+			s, err := volume.treeSize(path.Join(relPath, e.name))
+			if err != nil {
+				return 0, err
+			}
+			total += s
+		}
+	}
+	return total, nil
+}
+
+// copyTree copies "srcPath" to "dstPath", which must not exist. Directories
+// are only copied if "recursive" is set. In recursive copies, entries that
+// are neither regular files, directories nor symlinks are skipped.
+//
+// If the copy fails or is aborted, the file being copied is removed, the
+// entries copied before are kept.
+func (c *copier) copyTree(srcPath, dstPath string, recursive bool) error {
+	mode, _, _, err := c.src.stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if mode&syscall.S_IFMT == syscall.S_IFDIR {
+		if !recursive {
+			return syscall.EISDIR
+		}
+		// Don't copy a directory into itself
+		if c.src == c.dst && strings.HasPrefix(path.Clean(dstPath)+"/", path.Clean(srcPath)+"/") {
+			return syscall.EINVAL
+		}
+	}
+	c.total, err = c.src.treeSize(srcPath)
+	if err != nil {
+		return err
+	}
+	c.done = 0
+	if !c.progress(c.done, c.total) {
+		return syscall.ECANCELED
+	}
+	return c.copyEntry(srcPath, dstPath)
+}
+
+func (c *copier) copyEntry(srcPath, dstPath string) error {
+	// listDir only returns the file type, get the permissions too
+	mode, _, _, err := c.src.stat(srcPath)
+	if err != nil {
+		return err
+	}
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		return c.copyFile(srcPath, dstPath, mode)
+	case syscall.S_IFLNK:
+		return c.copySymlink(srcPath, dstPath)
+	case syscall.S_IFDIR:
+		return c.copyDir(srcPath, dstPath, mode)
+	}
+	return nil
+}
+
+// copyDir creates "dstPath" and copies the content of "srcPath" into it. The
+// permissions are applied at the end so that read-only directories can be
+// filled.
+func (c *copier) copyDir(srcPath, dstPath string, mode uint32) error {
+	entries, err := c.src.listDir(srcPath, false)
+	if err != nil {
+		return err
+	}
+	err = c.dst.mkdir(dstPath, 0700)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = c.copyEntry(path.Join(srcPath, e.name), path.Join(dstPath, e.name))
+		if err != nil {
+			return err
+		}
+	}
+	return c.setDirMode(dstPath, mode)
+}
+
+// setDirMode applies the permissions of a copied directory, once it has been
+// filled.
+func (c *copier) setDirMode(dstPath string, mode uint32) error {
+	dirfd, cName, err := c.dst.prepareAtSyscall(dstPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	err = syscall.Fchmod(fd, mode&07777)
+	if err == nil {
+		c.dst.indexUpdateAt(dstPath, dirfd, cName)
+	}
+	return err
+}
+
+// copySymlink re-creates the symlink "srcPath" as "dstPath".
+func (c *copier) copySymlink(srcPath, dstPath string) (err error) {
+	srcDirfd, srcCName, err := c.src.prepareAtSyscallMyself(srcPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			c.dst.indexUpdate(dstPath)
+		}
+	}()
+	target := c.src.readlink(srcDirfd, srcCName)
+	syscall.Close(srcDirfd)
+	if target == nil {
+		return syscall.EIO
+	}
+	dirfd, cName, err := c.dst.prepareAtSyscall(dstPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	cTarget := string(target)
+	if !c.dst.plainTextNames {
+		cTarget = c.dst.encryptSymlinkTarget(cTarget)
+		// Handle long file name
+		if nametransform.IsLongContent(cName) {
+			// Create ".name"
+			err = c.dst.nameTransform.WriteLongNameAt(dirfd, cName, dstPath)
+			if err != nil {
+				return err
+			}
+			err = unix.Symlinkat(cTarget, dirfd, cName)
+			if err != nil {
+				nametransform.DeleteLongNameAt(dirfd, cName)
+			}
+			return err
+		}
+	}
+	return unix.Symlinkat(cTarget, dirfd, cName)
+}
+
+// copyFile copies the regular file "srcPath" to "dstPath", which is created
+// with "mode". Holes are preserved.
+func (c *copier) copyFile(srcPath, dstPath string, mode uint32) error {
+	dirfd, cName, err := c.src.prepareAtSyscallMyself(srcPath)
+	if err != nil {
+		return err
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	syscall.Close(dirfd)
+	if err != nil {
+		return err
+	}
+	srcFile := os.NewFile(uintptr(fd), cName)
+	defer srcFile.Close()
+
+	fd, cName, err = c.dst.createFile(dstPath, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	dstFile := os.NewFile(uintptr(fd), cName)
+	err = c.copyContent(srcFile, dstFile)
+	if err == nil {
+		// The mode passed to open() is subject to the umask
+		err = syscall.Fchmod(fd, mode&07777)
+	}
+	if err2 := dstFile.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		c.dst.removeFile(dstPath)
+	} else {
+		c.dst.indexUpdate(dstPath)
+	}
+	return err
+}
+
+// copyContent streams the ciphertext blocks of "srcFile", decrypts them with
+// the source file ID and writes them re-encrypted with a new file ID to
+// "dstFile". All-zero ciphertext blocks, including a short last one, are file
+// holes and are not written.
+//
+// The content locks of the handles the host opened on both files are held
+// during the copy, so that writes through them can't produce a torn copy.
+func (c *copier) copyContent(srcFile, dstFile *os.File) error {
+	unlockSrc, err := c.src.lockContent(srcFile, false)
+	if err != nil {
+		return err
+	}
+	defer unlockSrc()
+	unlockDst, err := c.dst.lockContent(dstFile, true)
+	if err != nil {
+		return err
+	}
+	defer unlockDst()
+
+	srcEnc := c.src.contentEnc
+	dstEnc := c.dst.contentEnc
+	srcID, err := readFileID(srcFile)
+	if err == io.EOF {
+		// Empty file
+		return nil
+	} else if err != nil {
+		return err
+	}
+	st, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+	plainSize := srcEnc.CipherSizeToPlainSize(uint64(st.Size()))
+	dstID, err := createHeader(dstFile)
+	if err != nil {
+		return err
+	}
+	cipherBS := srcEnc.CipherBS()
+	plainBS := srcEnc.PlainBS()
+	allZero := make([]byte, cipherBS)
+	// Copy MAX_KERNEL_WRITE plaintext bytes per iteration, like a host
+	// calling gcf_read_file and gcf_write_file would
+	chunkBlocks := uint64(contentenc.MAX_KERNEL_WRITE) / plainBS
+	buf := make([]byte, chunkBlocks*cipherBS)
+
+	// copyRun re-encrypts the consecutive non-hole blocks in "ciphertext",
+	// the first one being "firstBlockNo"
+	copyRun := func(ciphertext []byte, firstBlockNo uint64) error {
+		if len(ciphertext) == 0 {
+			return nil
+		}
+		plaintext, err := srcEnc.DecryptBlocks(ciphertext, firstBlockNo, srcID)
+		defer srcEnc.PReqPool.Put(plaintext)
+		if err != nil {
+			return err
+		}
+		c.done += uint64(len(plaintext))
+		blocks := make([][]byte, 0, (uint64(len(plaintext))+plainBS-1)/plainBS)
+		for off := uint64(0); off < uint64(len(plaintext)); off += plainBS {
+			blocks = append(blocks, plaintext[off:min(off+plainBS, uint64(len(plaintext)))])
+		}
+		out := dstEnc.EncryptBlocks(blocks, firstBlockNo, dstID)
+		defer dstEnc.CReqPool.Put(out)
+		cOff := int64(dstEnc.BlockNoToCipherOff(firstBlockNo))
+		// Prevent partially written (=corrupt) blocks
+		err = syscallcompat.EnospcPrealloc(int(dstFile.Fd()), cOff, int64(len(out)))
+		if err == nil {
+			_, err = dstFile.WriteAt(out, cOff)
+		}
+		return err
+	}
+
+	for firstBlockNo := uint64(0); ; firstBlockNo += chunkBlocks {
+		n, err := srcFile.ReadAt(buf, int64(srcEnc.BlockNoToCipherOff(firstBlockNo)))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		// Start of the current run of non-hole blocks in buf
+		runOff := uint64(0)
+		for off := uint64(0); off < uint64(n); off += cipherBS {
+			block := buf[off:min(off+cipherBS, uint64(n))]
+			if !bytes.Equal(block, allZero[:len(block)]) {
+				continue
+			}
+			// File hole
+			if err := copyRun(buf[runOff:off], firstBlockNo+runOff/cipherBS); err != nil {
+				return err
+			}
+			runOff = off + uint64(len(block))
+			c.done += srcEnc.CipherSizeToPlainSize(uint64(len(block)) + contentenc.HeaderLen)
+		}
+		if err := copyRun(buf[runOff:n], firstBlockNo+runOff/cipherBS); err != nil {
+			return err
+		}
+		if !c.progress(c.done, c.total) {
+			return syscall.ECANCELED
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	// Trailing holes
+	return dstFile.Truncate(int64(dstEnc.PlainSizeToCipherSize(plainSize)))
+}
+
+// gcf_copy_file copies the file "srcPath" to "dstPath" inside the volume.
+// The content is re-encrypted under a new file ID without passing through
+// the host. Holes and the file mode are preserved. "dstPath" must not exist.
+//
+// Directories are copied only if "recursive" is set. Symlinks are copied as
+// symlinks, other special files are skipped.
+//
+// "progressCallback" may be NULL. Otherwise it must point to a function
+// "int callback(int volumeID, unsigned long long done, unsigned long long total)"
+// which is called after every chunk with the number of plaintext bytes copied
+// so far. Returning non-zero aborts the copy. The file being copied when an
+// error occurs or when the copy is aborted is removed.
+//
+// Writes to the file being copied through handles opened before it are
+// blocked until its copy is done. The callback must not do such writes.
+//
+//export gcf_copy_file
+func gcf_copy_file(sessionID int, srcPath, dstPath string, recursive bool, progressCallback unsafe.Pointer) bool {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return false
+	}
+	defer volume.release()
+	c := copier{
+		src:      volume,
+		dst:      volume,
+		progress: hostProgress(progressCallback, sessionID),
+	}
+	return errToBool(c.copyTree(srcPath, dstPath, recursive))
+}
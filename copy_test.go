@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"libgocryptfs/v2/internal/syscallcompat"
+)
+
+// testData returns "n" bytes of a repeating pattern.
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i/4096)
+	}
+	return data
+}
+
+// readAll reads "size" bytes of "path" in chunks gcf_read_file accepts.
+func readAll(t *testing.T, volumeID int, path string, size int) []byte {
+	t.Helper()
+	handleID := gcf_open_read_mode(volumeID, path)
+	if handleID < 0 {
+		t.Fatalf("can't open %q", path)
+	}
+	defer gcf_close_file(volumeID, handleID)
+	out := make([]byte, 0, size)
+	buf := make([]byte, 100000)
+	for len(out) < size {
+		n := gcf_read_file(volumeID, handleID, uint64(len(out)), buf)
+		if n == 0 {
+			break
+		}
+		out = append(out, buf[:n]...)
+	}
+	return out
+}
+
+// copyFileTest copies "src" to "dst" with a Go progress function.
+func copyFileTest(volumeID int, src, dst string, recursive bool, progress progressFunc) error {
+	volume, _ := acquireVolume(volumeID)
+	defer volume.release()
+	c := copier{src: volume, dst: volume, progress: progress}
+	return c.copyTree(src, dst, recursive)
+}
+
+func TestCopyHoles(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	data := testData(100000)
+	handleID := gcf_open_write_mode(volumeID, "/f", 0640)
+	gcf_write_file(volumeID, handleID, 0, data)
+	// Hole of several blocks, then a partial last block
+	gcf_truncate(volumeID, "/f", 1000000)
+	gcf_write_file(volumeID, handleID, 1000000, data[:10])
+	gcf_close_file(volumeID, handleID)
+
+	var last, total uint64
+	err := copyFileTest(volumeID, "/f", "/g", false, func(done, t uint64) bool {
+		last, total = done, t
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != 1000010 || total != 1000010 {
+		t.Errorf("progress: %d of %d", last, total)
+	}
+	mode, size, _, _ := gcf_get_attrs(volumeID, "/g")
+	if size != 1000010 || mode&0777 != 0640 {
+		t.Fatalf("mode %o, size %d", mode, size)
+	}
+	want := make([]byte, 1000010)
+	copy(want, data)
+	copy(want[1000000:], data[:10])
+	if !bytes.Equal(readAll(t, volumeID, "/g", len(want)+1), want) {
+		t.Fatal("content differs")
+	}
+	// The hole is not allocated
+	volume := getVolume(t, volumeID)
+	dirfd, cName, _ := volume.prepareAtSyscall("/g")
+	defer syscall.Close(dirfd)
+	st, err := syscallcompat.Fstatat2(dirfd, cName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks*512 >= 1000000 {
+		t.Errorf("%d bytes allocated", st.Blocks*512)
+	}
+}
+
+// A short all-zero last block is a hole like a full one.
+func TestCopyZeroTail(t *testing.T) {
+	dir, volumeID := newTestVolume(t)
+	writeTestFile(t, volumeID, "/f", testData(5000))
+	cName := cipherNameOf(t, volumeID, "f")
+	cPath := filepath.Join(dir, cName)
+	st, _ := os.Stat(cPath)
+	volume := getVolume(t, volumeID)
+	tailOff := int64(volume.contentEnc.BlockNoToCipherOff(1))
+	fd, _ := os.OpenFile(cPath, os.O_WRONLY, 0)
+	fd.WriteAt(make([]byte, st.Size()-tailOff), tailOff)
+	fd.Close()
+
+	var last uint64
+	err := copyFileTest(volumeID, "/f", "/g", false, func(done, total uint64) bool {
+		last = done
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != 5000 {
+		t.Errorf("progress: %d", last)
+	}
+	if _, size, _, _ := gcf_get_attrs(volumeID, "/g"); size != 5000 {
+		t.Errorf("size %d", size)
+	}
+	if !bytes.Equal(readTestFile(t, volumeID, "/g", 4096), testData(4096)) {
+		t.Error("first block differs")
+	}
+}
+
+// Writes through open handles wait for the copy.
+func TestCopyLocksContent(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	data := testData(300000)
+	handleID := gcf_open_write_mode(volumeID, "/f", 0600)
+	for off := 0; off < len(data); off += 100000 {
+		gcf_write_file(volumeID, handleID, uint64(off), data[off:off+100000])
+	}
+	written := make(chan struct{})
+	started := false
+	err := copyFileTest(volumeID, "/f", "/g", false, func(done, total uint64) bool {
+		if done > 0 && !started {
+			started = true
+			go func() {
+				gcf_write_file(volumeID, handleID, 200000, bytes.Repeat([]byte{1}, 100))
+				close(written)
+			}()
+			time.Sleep(50 * time.Millisecond)
+		}
+		select {
+		case <-written:
+			t.Error("write during the copy")
+		default:
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-written
+	gcf_close_file(volumeID, handleID)
+	if !bytes.Equal(readAll(t, volumeID, "/g", len(data)), data) {
+		t.Fatal("torn copy")
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	gcf_mkdir(volumeID, "/d", 0750)
+	long := strings.Repeat("x", 200)
+	writeTestFile(t, volumeID, "/d/"+long, []byte("hello"))
+	writeTestFile(t, volumeID, "/d/empty", nil)
+
+	if gcf_copy_file(volumeID, "/d", "/e", false, nil) {
+		t.Fatal("copied a directory without recursive")
+	}
+	if gcf_copy_file(volumeID, "/d", "/d/sub", true, nil) {
+		t.Fatal("copied a directory into itself")
+	}
+	if !gcf_copy_file(volumeID, "/d", "/e", true, nil) {
+		t.Fatal("gcf_copy_file failed")
+	}
+	if mode, _, _, _ := gcf_get_attrs(volumeID, "/e"); mode&0777 != 0750 {
+		t.Errorf("mode %o", mode)
+	}
+	if string(readTestFile(t, volumeID, "/e/"+long, 10)) != "hello" {
+		t.Error("long name file differs")
+	}
+	if _, size, _, ok := gcf_get_attrs(volumeID, "/e/empty"); !ok || size != 0 {
+		t.Error("empty file not copied")
+	}
+	if gcf_copy_file(volumeID, "/d/empty", "/e/empty", false, nil) {
+		t.Error("overwrote an existing file")
+	}
+	// An aborted copy leaves no partial file
+	err := copyFileTest(volumeID, "/d/"+long, "/aborted", false, func(done, total uint64) bool {
+		return done == 0
+	})
+	if err != syscall.ECANCELED {
+		t.Errorf("got %v", err)
+	}
+	if _, _, _, ok := gcf_get_attrs(volumeID, "/aborted"); ok {
+		t.Error("aborted copy left a file")
+	}
+}
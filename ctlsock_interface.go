@@ -0,0 +1,253 @@
+package main
+
+import (
+	"C"
+	"path"
+	"strings"
+	"syscall"
+
+	"libgocryptfs/v2/internal/ctlsocksrv"
+	"libgocryptfs/v2/internal/nametransform"
+	"libgocryptfs/v2/internal/syscallcompat"
+)
+
+// encryptPath translates the plaintext path "plainPath" into the ciphertext
+// path relative to the root of the ciphertext directory. Long names are
+// returned in their hashed form, as they appear on disk.
+//
+// Symlink-safe through prepareAtSyscall().
+func (volume *Volume) encryptPath(plainPath string) (string, error) {
+	plainPath = strings.Trim(plainPath, "/")
+	if plainPath == "" {
+		// Empty string gets encrypted as empty string
+		return plainPath, nil
+	}
+	if volume.plainTextNames {
+		return plainPath, nil
+	}
+	// Encrypt path level by level using prepareAtSyscall. This also fills the
+	// dirCache with the parent directories.
+	parts := strings.Split(plainPath, "/")
+	wd := ""
+	cPath := ""
+	for _, part := range parts {
+		wd = wd + "/" + part
+		dirfd, cName, err := volume.prepareAtSyscall(wd)
+		if err != nil {
+			return "", err
+		}
+		syscall.Close(dirfd)
+		cPath = path.Join(cPath, cName)
+	}
+	return cPath, nil
+}
+
+// decryptPath translates the ciphertext path "cipherPath", relative to the
+// root of the ciphertext directory, into a plaintext path starting with "/".
+func (volume *Volume) decryptPath(cipherPath string) (string, error) {
+	dirfd, _, err := volume.prepareAtSyscallMyself("/")
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(dirfd)
+	return volume.decryptPathAt(dirfd, strings.Trim(cipherPath, "/"))
+}
+
+// decryptPathAt decrypts a ciphertext path relative to dirfd.
+//
+// Symlink-safe through ReadDirIVAt() and ReadLongNameAt().
+func (volume *Volume) decryptPathAt(dirfd int, cipherPath string) (plainPath string, err error) {
+	if volume.plainTextNames || cipherPath == "" {
+		return "/" + cipherPath, nil
+	}
+	parts := strings.Split(cipherPath, "/")
+	wd := dirfd
+	plainPath = "/"
+	for i, part := range parts {
+		dirIV, err := volume.nameTransform.ReadDirIVAt(wd)
+		if err != nil {
+			return "", err
+		}
+		longPart := part
+		if nametransform.IsLongContent(part) {
+			longPart, err = nametransform.ReadLongNameAt(wd, part)
+			if err != nil {
+				return "", err
+			}
+		}
+		name, err := volume.nameTransform.DecryptName(longPart, dirIV)
+		if err != nil {
+			return "", err
+		}
+		plainPath = path.Join(plainPath, name)
+		// Last path component? We are done.
+		if i == len(parts)-1 {
+			break
+		}
+		// Descend into next directory
+		wd, err = syscallcompat.Openat(wd, part, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		if err != nil {
+			return "", err
+		}
+		// Yes this is somewhat wasteful in terms of used file descriptors:
+		// we keep them all open until the function returns. But it is simple
+		// and reliable.
+		defer syscall.Close(wd)
+	}
+	return plainPath, nil
+}
+
+// gcf_encrypt_path returns the path of the ciphertext file or directory
+// backing "plainPath", relative to the ciphertext directory, or NULL on error.
+// The host must free the returned string.
+//
+//export gcf_encrypt_path
+func gcf_encrypt_path(sessionID int, plainPath string) *C.char {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return nil
+	}
+	defer volume.release()
+	cPath, err := volume.encryptPath(plainPath)
+	if err != nil {
+		return nil
+	}
+	return C.CString(cPath)
+}
+
+// gcf_decrypt_path returns the plaintext path of the ciphertext path
+// "cipherPath" (relative to the ciphertext directory), or NULL on error.
+// The host must free the returned string.
+//
+//export gcf_decrypt_path
+func gcf_decrypt_path(sessionID int, cipherPath string) *C.char {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return nil
+	}
+	defer volume.release()
+	plainPath, err := volume.decryptPath(cipherPath)
+	if err != nil {
+		return nil
+	}
+	return C.CString(plainPath)
+}
+
+// ctlSockBackend serves ctlsock requests on a volume. Each request counts as
+// an in-flight operation, like API calls.
+type ctlSockBackend struct {
+	volume *Volume
+}
+
+var _ ctlsocksrv.Interface = &ctlSockBackend{}
+
+// acquire registers a new operation on the volume. Returns EBADF if the volume
+// is closing.
+func (b *ctlSockBackend) acquire() error {
+	if !b.volume.ops.begin() {
+		return syscall.EBADF
+	}
+	b.volume.touch()
+	return nil
+}
+
+// EncryptPath implements ctlsocksrv.Interface.
+func (b *ctlSockBackend) EncryptPath(plainPath string) (string, error) {
+	if err := b.acquire(); err != nil {
+		return "", err
+	}
+	defer b.volume.release()
+	return b.volume.encryptPath(plainPath)
+}
+
+// DecryptPath implements ctlsocksrv.Interface. Like gocryptfs, the result has
+// no leading slash.
+func (b *ctlSockBackend) DecryptPath(cipherPath string) (string, error) {
+	if err := b.acquire(); err != nil {
+		return "", err
+	}
+	defer b.volume.release()
+	plainPath, err := b.volume.decryptPath(cipherPath)
+	return strings.TrimPrefix(plainPath, "/"), err
+}
+
+// ListDir implements ctlsocksrv.Interface.
+func (b *ctlSockBackend) ListDir(dirName string) ([]ctlsocksrv.DirEntry, error) {
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	defer b.volume.release()
+	entries, err := b.volume.listDir("/"+dirName, false)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ctlsocksrv.DirEntry, len(entries))
+	for i := range entries {
+		out[i] = ctlsocksrv.DirEntry{Name: entries[i].name, Mode: entries[i].mode}
+	}
+	return out, nil
+}
+
+// Stat implements ctlsocksrv.Interface.
+func (b *ctlSockBackend) Stat(relPath string) (*ctlsocksrv.StatStruct, error) {
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	defer b.volume.release()
+	mode, size, mtime, err := b.volume.stat("/" + relPath)
+	if err != nil {
+		return nil, err
+	}
+	return &ctlsocksrv.StatStruct{Mode: mode, Size: size, Mtime: mtime}, nil
+}
+
+// stopCtlSock stops the control socket server, if any.
+func (volume *Volume) stopCtlSock() bool {
+	volume.ctlSockLock.Lock()
+	defer volume.ctlSockLock.Unlock()
+	if volume.ctlSock == nil {
+		return false
+	}
+	volume.ctlSock.Close()
+	volume.ctlSock = nil
+	return true
+}
+
+// gcf_start_ctlsock serves the gocryptfs control socket protocol on a unix
+// socket created at "socketPath", so that tools like gocryptfs-xray or
+// scripts written for "gocryptfs -ctlsock" can translate paths of this
+// volume. ListDir and Stat requests are also supported. The socket is only
+// accessible by the current user and is removed when the volume is closed or
+// when gcf_stop_ctlsock is called.
+//
+//export gcf_start_ctlsock
+func gcf_start_ctlsock(sessionID int, socketPath string) bool {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return false
+	}
+	defer volume.release()
+	volume.ctlSockLock.Lock()
+	defer volume.ctlSockLock.Unlock()
+	if volume.ctlSock != nil {
+		return false
+	}
+	sock, err := ctlsocksrv.Listen(socketPath)
+	if err != nil {
+		return false
+	}
+	volume.ctlSock = ctlsocksrv.Serve(sock, &ctlSockBackend{volume})
+	return true
+}
+
+// gcf_stop_ctlsock stops the server started by gcf_start_ctlsock.
+//
+//export gcf_stop_ctlsock
+func gcf_stop_ctlsock(sessionID int) bool {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return false
+	}
+	defer volume.release()
+	return volume.stopCtlSock()
+}
@@ -6,12 +6,9 @@ import (
 	"io"
 	"strings"
 	"syscall"
-	"unsafe"
 
 	"golang.org/x/sys/unix"
 
-	"libgocryptfs/v2/allocator"
-	"libgocryptfs/v2/internal/configfile"
 	"libgocryptfs/v2/internal/cryptocore"
 	"libgocryptfs/v2/internal/nametransform"
 	"libgocryptfs/v2/internal/syscallcompat"
@@ -40,27 +37,45 @@ func (volume *Volume) mkdirWithIv(dirfd int, cName string, mode uint32) error {
 	return err
 }
 
-//export gcf_list_dir
-func gcf_list_dir(sessionID int, dirName string) (*C.char, *C.int, C.int) {
-	value, ok := OpenedVolumes.Load(sessionID)
-	if !ok {
-		return nil, nil, 0
-	}
-	volume := value.(*Volume)
+// dirEntry is a directory entry as returned by listDir.
+type dirEntry struct {
+	// name is the plaintext name. For invalid entries, it is the name found
+	// on disk.
+	name string
+	// cName is the name found on disk
+	cName string
+	mode  uint32
+	// invalidReason explains why the entry could not be decrypted. Empty for
+	// valid entries.
+	invalidReason string
+}
+
+// listDir reads and decrypts the directory "dirName".
+// Entries that can't be decrypted are skipped, unless "withInvalid" is set.
+// In that case they are returned with their ciphertext name and the reason of
+// the failure.
+func (volume *Volume) listDir(dirName string, withInvalid bool) ([]dirEntry, error) {
 	parentDirFd, cDirName, err := volume.prepareAtSyscallMyself(dirName)
 	if err != nil {
-		return nil, nil, 0
+		return nil, err
 	}
 	defer syscall.Close(parentDirFd)
 	// Read ciphertext directory
 	fd, err := syscallcompat.Openat(parentDirFd, cDirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
-		return nil, nil, 0
+		return nil, err
 	}
 	defer syscall.Close(fd)
+	return volume.readDirAt(fd, dirName == "/", withInvalid)
+}
+
+// readDirAt is like listDir but reads the already opened directory "fd".
+// "isRoot" tells if it is the root of the volume, where gocryptfs.conf must
+// be hidden.
+func (volume *Volume) readDirAt(fd int, isRoot bool, withInvalid bool) ([]dirEntry, error) {
 	cipherEntries, err := syscallcompat.Getdents(fd)
 	if err != nil {
-		return nil, nil, 0
+		return nil, err
 	}
 	// Get DirIV (stays nil if PlaintextNames is used)
 	var cachedIV []byte
@@ -68,80 +83,310 @@ func gcf_list_dir(sessionID int, dirName string) (*C.char, *C.int, C.int) {
 		// Read the DirIV from disk
 		cachedIV, err = volume.nameTransform.ReadDirIVAt(fd)
 		if err != nil {
-			return nil, nil, 0
+			return nil, err
+		}
+	}
+	// Needed to detect orphaned "gocryptfs.longname.*.name" files
+	var cipherNames map[string]bool
+	if withInvalid && !volume.plainTextNames {
+		cipherNames = make(map[string]bool, len(cipherEntries))
+		for i := range cipherEntries {
+			cipherNames[cipherEntries[i].Name] = true
 		}
 	}
 	// Decrypted directory entries
-	var plain strings.Builder
-	var modes []uint32
+	entries := make([]dirEntry, 0, len(cipherEntries))
+	invalid := func(i int, reason string) {
+		if withInvalid {
+			entries = append(entries, dirEntry{
+				name:          cipherEntries[i].Name,
+				cName:         cipherEntries[i].Name,
+				mode:          cipherEntries[i].Mode,
+				invalidReason: reason,
+			})
+		}
+	}
 	// Filter and decrypt filenames
 	for i := range cipherEntries {
 		cName := cipherEntries[i].Name
-		if dirName == "/" && cName == configfile.ConfDefaultName {
-			// silently ignore "gocryptfs.conf" in the top level dir
+		if (isRoot && isReservedRootName(cName)) || isExchangeTmpName(cName) {
+			// silently ignore "gocryptfs.conf" and our internal files in the
+			// top level dir, and leftovers of the RENAME_EXCHANGE emulation
 			continue
 		}
 		if volume.plainTextNames {
-			plain.WriteString(cipherEntries[i].Name + "\x00")
-			modes = append(modes, cipherEntries[i].Mode)
+			entries = append(entries, dirEntry{name: cName, cName: cName, mode: cipherEntries[i].Mode})
 			continue
 		}
-		if cName == nametransform.DirIVFilename {
-			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
+		name, reason := volume.decryptEntryName(fd, cName, cachedIV, func(name string) bool {
+			return cipherNames[name]
+		})
+		if reason != "" {
+			invalid(i, reason)
 			continue
 		}
-		// Handle long file name
-		isLong := nametransform.NameType(cName)
-		if isLong == nametransform.LongNameContent {
-			cNameLong, err := nametransform.ReadLongNameAt(fd, cName)
-			if err != nil {
-				continue
-			}
-			cName = cNameLong
-		} else if isLong == nametransform.LongNameFilename {
-			// ignore "gocryptfs.longname.*.name"
+		if name == "" {
 			continue
 		}
-		name, err := volume.nameTransform.DecryptName(cName, cachedIV)
+		entries = append(entries, dirEntry{name: name, cName: cName, mode: cipherEntries[i].Mode})
+	}
+	return entries, nil
+}
+
+// decryptEntryName decrypts the name of the entry "cName" in the directory
+// "fd" whose DirIV is "iv". Internal files, like gocryptfs.diriv and long name
+// files, get an empty name. If the entry can't be decrypted, "invalidReason"
+// tells why. "exists" tells if another entry of the directory exists, to
+// detect orphaned long name files.
+func (volume *Volume) decryptEntryName(fd int, cName string, iv []byte, exists func(string) bool) (name string, invalidReason string) {
+	if cName == nametransform.DirIVFilename {
+		// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
+		return "", ""
+	}
+	// Handle long file name
+	cNameLong := cName
+	isLong := nametransform.NameType(cName)
+	if isLong == nametransform.LongNameContent {
+		var err error
+		cNameLong, err = nametransform.ReadLongNameAt(fd, cName)
 		if err != nil {
-			continue
+			if !volume.nameTransform.HaveBadnamePatterns() {
+				return "", fmt.Sprintf("cannot read long name: %v", err)
+			}
+			// The .name file is missing (e.g. renamed by a sync tool).
+			// Let the badname patterns decide about the hashed name.
+			cNameLong = cName
+		}
+	} else if isLong == nametransform.LongNameFilename {
+		// ignore "gocryptfs.longname.*.name"
+		if !exists(nametransform.RemoveLongNameSuffix(cName)) {
+			return "", "orphaned long name file"
+		}
+		return "", ""
+	}
+	name, err := volume.nameTransform.DecryptName(cNameLong, iv)
+	if err != nil {
+		return "", fmt.Sprintf("cannot decrypt name: %v", err)
+	}
+	if isLong == nametransform.LongNameContent && strings.HasSuffix(name, nametransform.BadnameSuffix) {
+		// Show the on-disk (hashed) name, the full ciphertext name
+		// can't be resolved back by prepareAtSyscall.
+		name = cName + nametransform.BadnameSuffix
+	}
+	return name, ""
+}
+
+//export gcf_list_dir
+func gcf_list_dir(sessionID int, dirName string) (*C.char, *C.int, C.int) {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return nil, nil, 0
+	}
+	defer volume.release()
+	entries, err := volume.listDir(dirName, false)
+	if err != nil {
+		return nil, nil, 0
+	}
+	var plain strings.Builder
+	modes := make([]uint32, len(entries))
+	for i := range entries {
+		plain.WriteString(entries[i].name + "\x00")
+		modes[i] = entries[i].mode
+	}
+	return C.CString(plain.String()), cIntArray(modes), (C.int)(len(modes))
+}
+
+// gcf_list_dir_with_invalid is like gcf_list_dir but also returns the entries
+// that can't be decrypted (corrupted names, missing or orphaned long name
+// files, garbage left by sync tools...).
+//
+// The third return value is a NUL-separated list with one reason per entry.
+// It is empty for valid entries. Invalid entries are listed with their
+// ciphertext name, which can be passed to gcf_remove_invalid_entry or
+// gcf_quarantine_invalid_entry.
+//
+//export gcf_list_dir_with_invalid
+func gcf_list_dir_with_invalid(sessionID int, dirName string) (*C.char, *C.int, *C.char, C.int) {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return nil, nil, nil, 0
+	}
+	defer volume.release()
+	entries, err := volume.listDir(dirName, true)
+	if err != nil {
+		return nil, nil, nil, 0
+	}
+	var plain, reasons strings.Builder
+	modes := make([]uint32, len(entries))
+	for i := range entries {
+		plain.WriteString(entries[i].name + "\x00")
+		reasons.WriteString(entries[i].invalidReason + "\x00")
+		modes[i] = entries[i].mode
+	}
+	return C.CString(plain.String()), cIntArray(modes), C.CString(reasons.String()), (C.int)(len(modes))
+}
+
+// openRawEntry opens the directory "dirName" and checks that "cipherName"
+// is a name that may be manipulated through the raw entry API: no internal
+// file, no path separator, and an entry gcf_list_dir_with_invalid reports as
+// invalid. Valid entries must be changed through their plaintext path.
+func (volume *Volume) openRawEntry(dirName string, cipherName string) (dirfd int, err error) {
+	if nametransform.IsValidName(cipherName) != nil {
+		return -1, syscall.EINVAL
+	}
+	if cipherName == nametransform.DirIVFilename || isExchangeTmpName(cipherName) ||
+		(dirName == "/" && isReservedRootName(cipherName)) {
+		return -1, syscall.EPERM
+	}
+	if volume.plainTextNames {
+		// Every name is valid
+		return -1, syscall.EPERM
+	}
+	parentDirFd, cDirName, err := volume.prepareAtSyscallMyself(dirName)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(parentDirFd)
+	dirfd, err = syscallcompat.Openat(parentDirFd, cDirName, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0)
+	if err != nil {
+		return -1, err
+	}
+	iv, err := volume.nameTransform.ReadDirIVAt(dirfd)
+	if err != nil {
+		syscall.Close(dirfd)
+		return -1, err
+	}
+	_, reason := volume.decryptEntryName(dirfd, cipherName, iv, func(name string) bool {
+		_, err := syscallcompat.Fstatat2(dirfd, name, unix.AT_SYMLINK_NOFOLLOW)
+		return err == nil
+	})
+	if reason == "" {
+		syscall.Close(dirfd)
+		return -1, syscall.EPERM
+	}
+	return dirfd, nil
+}
+
+// gcf_remove_invalid_entry deletes the ciphertext entry "cipherName" found in
+// "dirName", as reported by gcf_list_dir_with_invalid. The matching long name
+// file is deleted as well. Directories are only deleted if they are empty.
+// Fails for entries that can be decrypted.
+//
+//export gcf_remove_invalid_entry
+func gcf_remove_invalid_entry(sessionID int, dirName string, cipherName string) bool {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return false
+	}
+	defer volume.release()
+	dirfd, err := volume.openRawEntry(dirName, cipherName)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(dirfd)
+	st, err := syscallcompat.Fstatat2(dirfd, cipherName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return false
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		// Only removes the directory if it holds nothing but its
+		// gocryptfs.diriv, which is put back otherwise. Also deletes the
+		// long name file.
+		err = volume.rmdirAt(dirfd, cipherName)
+	} else {
+		err = syscallcompat.Unlinkat(dirfd, cipherName, 0)
+		if err == nil && nametransform.IsLongContent(cipherName) {
+			// May not exist
+			nametransform.DeleteLongNameAt(dirfd, cipherName)
+		}
+	}
+	if err != nil {
+		return false
+	}
+	// A plaintext path may still be cached for this directory
+	volume.dirCache.Clear()
+	return true
+}
+
+// gcf_quarantine_invalid_entry moves the ciphertext entry "cipherName" found
+// in "dirName" to the plaintext path "newPath", for example into a quarantine
+// folder, so that it becomes accessible again. File content does not depend
+// on the name, so a file whose name got corrupted can be read again
+// afterwards. Fails if "newPath" already exists or if the entry can be
+// decrypted.
+//
+//export gcf_quarantine_invalid_entry
+func gcf_quarantine_invalid_entry(sessionID int, dirName string, cipherName string, newPath string) bool {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return false
+	}
+	defer volume.release()
+	dirfd, err := volume.openRawEntry(dirName, cipherName)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(dirfd)
+	newDirfd, newCName, err := volume.prepareAtSyscall(newPath)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(newDirfd)
+	if nametransform.IsLongContent(newCName) {
+		// Fails with EEXIST if "newPath" exists
+		err = volume.nameTransform.WriteLongNameAt(newDirfd, newCName, newPath)
+		if err != nil {
+			return false
+		}
+	}
+	// Never replace an entry created after the checks
+	err = syscallcompat.Renameat2(dirfd, cipherName, newDirfd, newCName, syscallcompat.RENAME_NOREPLACE)
+	if err != nil {
+		if nametransform.IsLongContent(newCName) {
+			nametransform.DeleteLongNameAt(newDirfd, newCName)
 		}
-		// Override the ciphertext name with the plaintext name but reuse the rest
-		// of the structure
-		cipherEntries[i].Name = name
-		plain.WriteString(cipherEntries[i].Name + "\x00")
-		modes = append(modes, cipherEntries[i].Mode)
-	}
-	p := allocator.Malloc(len(modes))
-	for i := 0; i < len(modes); i++ {
-		offset := C.sizeof_int * uintptr(i)
-		*(*C.int)(unsafe.Pointer(uintptr(p) + offset)) = (C.int)(modes[i])
-	}
-	return C.CString(plain.String()), (*C.int)(p), (C.int)(len(modes))
+		return false
+	}
+	if nametransform.IsLongContent(cipherName) {
+		// May not exist
+		nametransform.DeleteLongNameAt(dirfd, cipherName)
+	}
+	volume.dirCache.Clear()
+	volume.indexUpdate(newPath)
+	return true
 }
 
 //export gcf_mkdir
 func gcf_mkdir(sessionID int, path string, mode uint32) bool {
-	value, ok := OpenedVolumes.Load(sessionID)
+	volume, ok := acquireVolume(sessionID)
 	if !ok {
 		return false
 	}
-	volume := value.(*Volume)
+	defer volume.release()
+	err := volume.mkdir(path, mode)
+	if err == nil {
+		volume.indexUpdate(path)
+	}
+	return errToBool(err)
+}
+
+// mkdir creates the directory "path" with its gocryptfs.diriv file.
+func (volume *Volume) mkdir(path string, mode uint32) error {
 	dirfd, cName, err := volume.prepareAtSyscall(path)
 	if err != nil {
-		return false
+		return err
 	}
 	defer syscall.Close(dirfd)
 
 	if volume.plainTextNames {
 		err = unix.Mkdirat(dirfd, cName, mode)
 		if err != nil {
-			return false
+			return err
 		}
 		var ust unix.Stat_t
 		err = syscallcompat.Fstatat(dirfd, cName, &ust, unix.AT_SYMLINK_NOFOLLOW)
 		if err != nil {
-			return false
+			return err
 		}
 	} else {
 		// We need write and execute permissions to create gocryptfs.diriv.
@@ -155,33 +400,33 @@ func gcf_mkdir(sessionID int, path string, mode uint32) bool {
 			// Create ".name"
 			err = volume.nameTransform.WriteLongNameAt(dirfd, cName, path)
 			if err != nil {
-				return false
+				return err
 			}
 
 			// Create directory
 			err = volume.mkdirWithIv(dirfd, cName, mode)
 			if err != nil {
 				nametransform.DeleteLongNameAt(dirfd, cName)
-				return false
+				return err
 			}
 		} else {
 			err = volume.mkdirWithIv(dirfd, cName, mode)
 			if err != nil {
-				return false
+				return err
 			}
 		}
 
 		fd, err := syscallcompat.Openat(dirfd, cName,
 			syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 		if err != nil {
-			return false
+			return err
 		}
 		defer syscall.Close(fd)
 
 		var st syscall.Stat_t
 		err = syscall.Fstat(fd, &st)
 		if err != nil {
-			return false
+			return err
 		}
 
 		// Fix permissions
@@ -192,45 +437,59 @@ func gcf_mkdir(sessionID int, path string, mode uint32) bool {
 		}
 	}
 
-	return true
+	return nil
 }
 
 //export gcf_rmdir
 func gcf_rmdir(sessionID int, relPath string) bool {
-	value, ok := OpenedVolumes.Load(sessionID)
+	volume, ok := acquireVolume(sessionID)
 	if !ok {
 		return false
 	}
-	volume := value.(*Volume)
+	defer volume.release()
+	return volume.rmdir(relPath)
+}
+
+func (volume *Volume) rmdir(relPath string) bool {
 	parentDirFd, cName, err := volume.prepareAtSyscall(relPath)
 	if err != nil {
 		return false
 	}
 	defer syscall.Close(parentDirFd)
+	err = volume.rmdirAt(parentDirFd, cName)
+	if err != nil {
+		return false
+	}
+	volume.dirCache.Delete(relPath)
+	volume.indexRemove(relPath)
+	return true
+}
+
+// rmdirAt removes the empty directory "cName" in "parentDirFd", with its
+// gocryptfs.diriv and .name files.
+func (volume *Volume) rmdirAt(parentDirFd int, cName string) error {
 	if volume.plainTextNames {
 		// Unlinkat with AT_REMOVEDIR is equivalent to Rmdir
-		err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
-		return errToBool(err)
+		return unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
 	}
 	dirfd, err := syscallcompat.Openat(parentDirFd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
-		return false
+		return err
 	}
 	defer syscall.Close(dirfd)
 	// Check directory contents
 	children, err := syscallcompat.Getdents(dirfd)
 	if err == io.EOF {
 		// The directory is empty
-		err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
-		return errToBool(err)
+		return unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
 	}
 	if err != nil {
-		return false
+		return err
 	}
 	// If the directory is not empty besides gocryptfs.diriv, do not even
 	// attempt the dance around gocryptfs.diriv.
 	if len(children) > 1 {
-		return false
+		return syscall.ENOTEMPTY
 	}
 	// Move "gocryptfs.diriv" to the parent dir as "gocryptfs.diriv.rmdir.XYZ"
 	tmpName := fmt.Sprintf("%s.rmdir.%d", nametransform.DirIVFilename, cryptocore.RandUint64())
@@ -240,7 +499,7 @@ func gcf_rmdir(sessionID int, relPath string) bool {
 	defer volume.dirIVLock.Unlock()
 	err = syscallcompat.Renameat(dirfd, nametransform.DirIVFilename, parentDirFd, tmpName)
 	if err != nil {
-		return false
+		return err
 	}
 	// Actual Rmdir
 	err = syscallcompat.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
@@ -248,7 +507,7 @@ func gcf_rmdir(sessionID int, relPath string) bool {
 		// This can happen if another file in the directory was created in the
 		// meantime, undo the rename
 		syscallcompat.Renameat(parentDirFd, tmpName, dirfd, nametransform.DirIVFilename)
-		return errToBool(err)
+		return err
 	}
 	// Delete "gocryptfs.diriv.rmdir.XYZ"
 	syscallcompat.Unlinkat(parentDirFd, tmpName, 0)
@@ -256,6 +515,5 @@ func gcf_rmdir(sessionID int, relPath string) bool {
 	if nametransform.IsLongContent(cName) {
 		nametransform.DeleteLongNameAt(parentDirFd, cName)
 	}
-	volume.dirCache.Delete(relPath)
-	return true
+	return nil
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"libgocryptfs/v2/internal/nametransform"
+)
+
+// cipherNameOf returns the ciphertext name of the entry "name" in the root
+// directory.
+func cipherNameOf(t *testing.T, volumeID int, name string) string {
+	t.Helper()
+	entries, err := getVolume(t, volumeID).listDir("/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.name == name {
+			return e.cName
+		}
+	}
+	t.Fatalf("%q not found", name)
+	return ""
+}
+
+// corruptName renames the ciphertext of the root entry "name" to "newCName".
+func corruptName(t *testing.T, dir string, volumeID int, name string, newCName string) {
+	t.Helper()
+	cName := cipherNameOf(t, volumeID, name)
+	if err := os.Rename(filepath.Join(dir, cName), filepath.Join(dir, newCName)); err != nil {
+		t.Fatal(err)
+	}
+	getVolume(t, volumeID).dirCache.Clear()
+}
+
+func TestListDirWithInvalid(t *testing.T) {
+	dir, volumeID := newTestVolume(t)
+	writeTestFile(t, volumeID, "/valid", []byte("v"))
+	writeTestFile(t, volumeID, "/corrupt", []byte("c"))
+	corruptName(t, dir, volumeID, "corrupt", "garbage")
+	orphan := "gocryptfs.longname." + strings.Repeat("A", 43) + nametransform.LongNameSuffix
+	os.WriteFile(filepath.Join(dir, orphan), []byte("x"), 0400)
+
+	volume := getVolume(t, volumeID)
+	entries, err := volume.listDir("/", false)
+	if err != nil || len(entries) != 1 || entries[0].name != "valid" {
+		t.Fatalf("listDir: %v, %v", entries, err)
+	}
+	entries, err = volume.listDir("/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]string)
+	for _, e := range entries {
+		reasons[e.name] = e.invalidReason
+	}
+	if len(reasons) != 3 || reasons["valid"] != "" || reasons["garbage"] == "" || reasons[orphan] == "" {
+		t.Fatalf("listDir with invalid: %v", entries)
+	}
+	if !gcf_remove_invalid_entry(volumeID, "/", orphan) {
+		t.Error("orphaned long name file not removed")
+	}
+}
+
+func TestRemoveInvalidEntry(t *testing.T) {
+	dir, volumeID := newTestVolume(t)
+	writeTestFile(t, volumeID, "/valid", []byte("v"))
+	writeTestFile(t, volumeID, "/corrupt", []byte("c"))
+	corruptName(t, dir, volumeID, "corrupt", "garbage")
+
+	if gcf_remove_invalid_entry(volumeID, "/", cipherNameOf(t, volumeID, "valid")) {
+		t.Fatal("removed a valid entry")
+	}
+	for _, name := range []string{"gocryptfs.conf", nametransform.DirIVFilename, "../garbage", "missing"} {
+		if gcf_remove_invalid_entry(volumeID, "/", name) {
+			t.Errorf("removed %q", name)
+		}
+	}
+	if !gcf_remove_invalid_entry(volumeID, "/", "garbage") {
+		t.Fatal("gcf_remove_invalid_entry failed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "garbage")); !os.IsNotExist(err) {
+		t.Fatal("entry still exists")
+	}
+	if string(readTestFile(t, volumeID, "/valid", 10)) != "v" {
+		t.Fatal("valid entry damaged")
+	}
+}
+
+func TestRemoveInvalidDirectory(t *testing.T) {
+	dir, volumeID := newTestVolume(t)
+	gcf_mkdir(volumeID, "/full", 0700)
+	writeTestFile(t, volumeID, "/full/f", nil)
+	gcf_mkdir(volumeID, "/empty", 0700)
+	corruptName(t, dir, volumeID, "full", "garbagefull")
+	corruptName(t, dir, volumeID, "empty", "garbageempty")
+
+	if gcf_remove_invalid_entry(volumeID, "/", "garbagefull") {
+		t.Fatal("removed a non-empty directory")
+	}
+	// The non-empty directory keeps its gocryptfs.diriv
+	if _, err := os.Stat(filepath.Join(dir, "garbagefull", nametransform.DirIVFilename)); err != nil {
+		t.Fatal(err)
+	}
+	if !gcf_remove_invalid_entry(volumeID, "/", "garbageempty") {
+		t.Fatal("empty directory not removed")
+	}
+}
+
+func TestQuarantineInvalidEntry(t *testing.T) {
+	dir, volumeID := newTestVolume(t)
+	writeTestFile(t, volumeID, "/valid", []byte("v"))
+	writeTestFile(t, volumeID, "/corrupt", []byte("content"))
+	corruptName(t, dir, volumeID, "corrupt", "garbage")
+	gcf_mkdir(volumeID, "/quarantine", 0700)
+
+	if gcf_quarantine_invalid_entry(volumeID, "/", cipherNameOf(t, volumeID, "valid"), "/quarantine/valid") {
+		t.Fatal("moved a valid entry")
+	}
+	if gcf_quarantine_invalid_entry(volumeID, "/", "garbage", "/valid") {
+		t.Fatal("replaced an existing entry")
+	}
+	if string(readTestFile(t, volumeID, "/valid", 10)) != "v" {
+		t.Fatal("existing entry damaged")
+	}
+	long := "/quarantine/" + strings.Repeat("x", 200)
+	if !gcf_quarantine_invalid_entry(volumeID, "/", "garbage", long) {
+		t.Fatal("gcf_quarantine_invalid_entry failed")
+	}
+	if string(readTestFile(t, volumeID, long, 10)) != "content" {
+		t.Fatal("quarantined file unreadable")
+	}
+	// A second entry can't take the same long name
+	writeTestFile(t, volumeID, "/corrupt2", nil)
+	corruptName(t, dir, volumeID, "corrupt2", "garbage2")
+	if gcf_quarantine_invalid_entry(volumeID, "/", "garbage2", long) {
+		t.Fatal("replaced an existing long name entry")
+	}
+	if string(readTestFile(t, volumeID, long, 10)) != "content" {
+		t.Fatal("existing long name entry damaged")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"libgocryptfs/v2/internal/contentenc"
+	"libgocryptfs/v2/internal/syscallcompat"
+)
+
+// writeEncryptedFile atomically replaces the internal file "name" in "dirfd"
+// with "plaintext", encrypted like file contents. Used for the files
+// libgocryptfs keeps inside the ciphertext directory.
+func (volume *Volume) writeEncryptedFile(dirfd int, name string, plaintext []byte) error {
+	tmpName := name + ".tmp"
+	fd, err := syscallcompat.Openat(dirfd, tmpName, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), tmpName)
+	err = volume.writeEncryptedContent(f, plaintext)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syscallcompat.Renameat(dirfd, tmpName, dirfd, name)
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(dirfd, tmpName, 0)
+	}
+	return err
+}
+
+func (volume *Volume) writeEncryptedContent(f *os.File, plaintext []byte) error {
+	if len(plaintext) == 0 {
+		return nil
+	}
+	fileID, err := createHeader(f)
+	if err != nil {
+		return err
+	}
+	// EncryptBlocks returns buffers from CReqPool, encrypt at most
+	// MAX_KERNEL_WRITE bytes at a time
+	bs := int(volume.contentEnc.PlainBS())
+	chunkLen := contentenc.MAX_KERNEL_WRITE
+	for off := 0; off < len(plaintext); off += chunkLen {
+		chunk := plaintext[off:min(off+chunkLen, len(plaintext))]
+		var blocks [][]byte
+		for i := 0; i < len(chunk); i += bs {
+			blocks = append(blocks, chunk[i:min(i+bs, len(chunk))])
+		}
+		blockNo := uint64(off / bs)
+		ciphertext := volume.contentEnc.EncryptBlocks(blocks, blockNo, fileID)
+		_, err = f.WriteAt(ciphertext, int64(volume.contentEnc.BlockNoToCipherOff(blockNo)))
+		volume.contentEnc.CReqPool.Put(ciphertext)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readEncryptedFile reads and decrypts the internal file "name" in "dirfd"
+// written by writeEncryptedFile.
+func (volume *Volume) readEncryptedFile(dirfd int, name string) ([]byte, error) {
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	fileID, err := readFileID(f)
+	if err == io.EOF {
+		// Empty file
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ciphertext, err := io.ReadAll(io.NewSectionReader(f, contentenc.HeaderLen, 1<<62))
+	if err != nil {
+		return nil, err
+	}
+	cipherBS := int(volume.contentEnc.CipherBS())
+	plaintext := make([]byte, 0, len(ciphertext))
+	for i := 0; i < len(ciphertext); i += cipherBS {
+		block, err := volume.contentEnc.DecryptBlock(ciphertext[i:min(i+cipherBS, len(ciphertext))], uint64(i/cipherBS), fileID)
+		if err != nil {
+			return nil, err
+		}
+		plaintext = append(plaintext, block...)
+	}
+	return plaintext, nil
+}
@@ -235,7 +235,10 @@ func (volume *Volume) doWrite(handleID int, data []byte, off uint64) (uint32, bo
 		if fileWasEmpty {
 			// Kill the file header again
 			syscall.Ftruncate(int(fd.Fd()), 0)
-			gcf_close_file(volume.volumeID, handleID)
+			// The next write creates a new header. The handle stays
+			// registered: the host still owns it, and closing it here
+			// would deadlock on fdLock, which our caller holds.
+			f.ID = nil
 		}
 		return 0, false
 	}
@@ -328,7 +331,7 @@ func (volume *Volume) truncate(handleID int, newSize uint64) bool {
 	}
 	// We need the old file size to determine if we are growing or shrinking
 	// the file
-	_, oldSize, _, success := gcf_get_attrs(volume.volumeID, f.path)
+	_, oldSize, _, success := volume.getAttrs(f.path)
 	if !success {
 		return false
 	}
@@ -369,11 +372,11 @@ func (volume *Volume) truncate(handleID int, newSize uint64) bool {
 
 //export gcf_open_read_mode
 func gcf_open_read_mode(sessionID int, path string) int {
-	value, ok := OpenedVolumes.Load(sessionID)
+	volume, ok := acquireVolume(sessionID)
 	if !ok {
 		return -1
 	}
-	volume := value.(*Volume)
+	defer volume.release()
 	dirfd, cName, err := volume.prepareAtSyscallMyself(path)
 	if err != nil {
 		return -1
@@ -390,54 +393,69 @@ func gcf_open_read_mode(sessionID int, path string) int {
 
 //export gcf_open_write_mode
 func gcf_open_write_mode(sessionID int, path string, mode uint32) int {
-	value, ok := OpenedVolumes.Load(sessionID)
+	volume, ok := acquireVolume(sessionID)
 	if !ok {
 		return -1
 	}
-	volume := value.(*Volume)
-	dirfd, cName, err := volume.prepareAtSyscall(path)
+	defer volume.release()
+	fd, cName, err := volume.createFile(path, mangleOpenFlags(syscall.O_RDWR)|syscall.O_CREAT, mode)
 	if err != nil {
 		return -1
 	}
+	volume.indexUpdate(path)
+	return volume.registerFileHandle(fd, cName, path)
+}
+
+// createFile opens or creates the backing file of "path", writing the
+// ".name" file first if the name is long. "flags" must contain O_CREAT.
+// Returns the fd and the ciphertext name.
+func (volume *Volume) createFile(path string, flags int, mode uint32) (int, string, error) {
+	dirfd, cName, err := volume.prepareAtSyscall(path)
+	if err != nil {
+		return -1, "", err
+	}
 	defer syscall.Close(dirfd)
 
 	fd := -1
-	newFlags := mangleOpenFlags(syscall.O_RDWR)
 	// Handle long file name
 	if !volume.plainTextNames && nametransform.IsLongContent(cName) {
 		// Create ".name"
 		err = volume.nameTransform.WriteLongNameAt(dirfd, cName, path)
 		if err != nil {
-			return -1
+			return -1, "", err
 		}
 		// Create content
-		fd, err = syscallcompat.Openat(dirfd, cName, newFlags|syscall.O_CREAT, mode)
+		fd, err = syscallcompat.Openat(dirfd, cName, flags, mode)
 		if err != nil {
 			nametransform.DeleteLongNameAt(dirfd, cName)
 		}
 	} else {
 		// Create content, normal (short) file name
-		fd, err = syscallcompat.Openat(dirfd, cName, newFlags|syscall.O_CREAT, mode)
+		fd, err = syscallcompat.Openat(dirfd, cName, flags, mode)
 	}
-	if err != nil {
-		return -1
-	}
-	return volume.registerFileHandle(fd, cName, path)
+	return fd, cName, err
 }
 
 //export gcf_truncate
 func gcf_truncate(sessionID int, path string, offset uint64) bool {
-	value, ok := OpenedVolumes.Load(sessionID)
+	volume, ok := acquireVolume(sessionID)
 	if !ok {
 		return false
 	}
-	volume := value.(*Volume)
-	for handleID, file := range volume.fileHandles {
+	defer volume.release()
+	handleID := -1
+	volume.handlesLock.RLock()
+	for id, file := range volume.fileHandles {
 		if file.path == path {
-			return volume.truncate(handleID, offset)
+			handleID = id
+			break
 		}
 	}
-	return false
+	volume.handlesLock.RUnlock()
+	if handleID == -1 {
+		return false
+	}
+	return volume.truncate(handleID, offset)
 }
 
 //export gcf_read_file
@@ -448,11 +466,11 @@ func gcf_read_file(sessionID, handleID int, offset uint64, dst_buff []byte) uint
 		return 0
 	}
 
-	value, ok := OpenedVolumes.Load(sessionID)
+	volume, ok := acquireVolume(sessionID)
 	if !ok {
 		return 0
 	}
-	volume := value.(*Volume)
+	defer volume.release()
 
 	volume.handlesLock.RLock()
 	f := volume.fileHandles[handleID]
@@ -477,11 +495,11 @@ func gcf_write_file(sessionID, handleID int, offset uint64, data []byte) uint32
 		return 0
 	}
 
-	value, ok := OpenedVolumes.Load(sessionID)
+	volume, ok := acquireVolume(sessionID)
 	if !ok {
 		return 0
 	}
-	volume := value.(*Volume)
+	defer volume.release()
 
 	volume.handlesLock.RLock()
 	f := volume.fileHandles[handleID]
@@ -494,43 +512,124 @@ func gcf_write_file(sessionID, handleID int, offset uint64, data []byte) uint32
 	return n
 }
 
+// lockContent takes the content lock of every handle open on the same file
+// as "file", for writing if "write" is set, and returns a function releasing
+// them. Handles opened afterwards are not covered.
+func (volume *Volume) lockContent(file *os.File, write bool) (func(), error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(file.Fd()), &st); err != nil {
+		return nil, err
+	}
+	var locked []*File
+	volume.handlesLock.RLock()
+	for _, f := range volume.fileHandles {
+		var fst syscall.Stat_t
+		if syscall.Fstat(int(f.fd.Fd()), &fst) != nil || fst.Dev != st.Dev || fst.Ino != st.Ino {
+			continue
+		}
+		locked = append(locked, f)
+	}
+	volume.handlesLock.RUnlock()
+	for _, f := range locked {
+		if write {
+			f.contentLock.Lock()
+		} else {
+			f.contentLock.RLock()
+		}
+	}
+	return func() {
+		for _, f := range locked {
+			if write {
+				f.contentLock.Unlock()
+			} else {
+				f.contentLock.RUnlock()
+			}
+		}
+	}, nil
+}
+
+// closeFile closes the file handle "handleID". If "flush" is set, the file
+// content is synced to disk before.
+func (volume *Volume) closeFile(handleID int, flush bool) bool {
+	f := volume.unregisterFile(handleID)
+	if f == nil {
+		return false
+	}
+	// Wait for reads and writes on this handle to finish
+	f.fdLock.Lock()
+	return volume.closeLockedFile(f, flush)
+}
+
+// unregisterFile removes the file handle "handleID" and returns its File, nil
+// if there is no such handle.
+func (volume *Volume) unregisterFile(handleID int) *File {
+	volume.handlesLock.Lock()
+	defer volume.handlesLock.Unlock()
+	f, ok := volume.fileHandles[handleID]
+	if !ok {
+		return nil
+	}
+	delete(volume.fileHandles, handleID)
+	return f
+}
+
+// closeLockedFile closes a File returned by unregisterFile. The caller must
+// hold f.fdLock, which is released.
+func (volume *Volume) closeLockedFile(f *File, flush bool) bool {
+	defer f.fdLock.Unlock()
+	if flush {
+		f.fd.Sync()
+	}
+	err := f.fd.Close()
+	// Size and mtime may have changed
+	volume.indexUpdate(f.path)
+	return errToBool(err)
+}
+
 //export gcf_close_file
 func gcf_close_file(sessionID, handleID int) {
-	value, ok := OpenedVolumes.Load(sessionID)
+	volume, ok := acquireVolume(sessionID)
 	if !ok {
 		return
 	}
-	volume := value.(*Volume)
-	volume.handlesLock.Lock()
-	f := volume.fileHandles[handleID]
-	f.fdLock.Lock()
-	f.fd.Close()
-	delete(volume.fileHandles, handleID)
-	volume.handlesLock.Unlock()
-	f.fdLock.Unlock()
+	defer volume.release()
+	volume.closeFile(handleID, false)
 }
 
 //export gcf_remove_file
 func gcf_remove_file(sessionID int, path string) bool {
-	value, ok := OpenedVolumes.Load(sessionID)
+	volume, ok := acquireVolume(sessionID)
 	if !ok {
 		return false
 	}
-	volume := value.(*Volume)
+	defer volume.release()
+	return errToBool(volume.removeFile(path))
+}
+
+// removeFile deletes the file (or symlink) "path" and its ".name" file.
+func (volume *Volume) removeFile(path string) error {
 	dirfd, cName, err := volume.prepareAtSyscall(path)
 	if err != nil {
-		return false
+		return err
 	}
 	defer syscall.Close(dirfd)
+	err = volume.unlinkAt(dirfd, cName)
+	if err == nil {
+		volume.indexRemove(path)
+	}
+	return err
+}
 
+// unlinkAt deletes the file "cName" in "dirfd" and its ".name" file.
+func (volume *Volume) unlinkAt(dirfd int, cName string) error {
 	// Delete content
-	err = syscallcompat.Unlinkat(dirfd, cName, 0)
+	err := syscallcompat.Unlinkat(dirfd, cName, 0)
 	if err != nil {
-		return false
+		return err
 	}
 	// Delete ".name" file
 	if !volume.plainTextNames && nametransform.IsLongContent(cName) {
 		err = nametransform.DeleteLongNameAt(dirfd, cName)
 	}
-	return errToBool(err)
+	return err
 }
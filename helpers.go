@@ -1,9 +1,13 @@
 package main
 
 import (
+	"C"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"unsafe"
 
+	"libgocryptfs/v2/allocator"
 	"libgocryptfs/v2/internal/configfile"
 	"libgocryptfs/v2/internal/syscallcompat"
 )
@@ -16,6 +20,29 @@ func getParentPath(path string) string {
 	return parent
 }
 
+// exchangeTmpPrefix starts the temporary names used by the RENAME_EXCHANGE
+// emulation. They can appear in any directory.
+const exchangeTmpPrefix = "gocryptfs.exchange."
+
+// isExchangeTmpName tells if "cName" is a temporary name of the
+// RENAME_EXCHANGE emulation, which is hidden from listings.
+func isExchangeTmpName(cName string) bool {
+	return strings.HasPrefix(cName, exchangeTmpPrefix)
+}
+
+// isReservedRootName tells if "cName" is the name of an internal file in the
+// root of the ciphertext directory, which is hidden from listings.
+func isReservedRootName(cName string) bool {
+	switch cName {
+	case configfile.ConfDefaultName, configfile.ConfDefaultName + ".tmp",
+		configfile.ConfBackupName, configfile.ConfBackupName + ".tmp",
+		indexFileName, indexFileName + ".tmp",
+		rekeyDirName, rekeyOldDirName, rekeyPartialName:
+		return true
+	}
+	return isExchangeTmpName(cName)
+}
+
 // isFiltered - check if plaintext "path" should be forbidden
 //
 // Prevents name clashes with internal files when file names are not encrypted
@@ -23,8 +50,14 @@ func (volume *Volume) isFiltered(path string) bool {
 	if !volume.plainTextNames {
 		return false
 	}
-	// gocryptfs.conf in the root directory is forbidden
-	if path == configfile.ConfDefaultName {
+	// gocryptfs.conf and our internal files in the root directory are
+	// forbidden
+	if isReservedRootName(strings.TrimPrefix(path, "/")) {
+		return true
+	}
+	// So are the temporary names of the RENAME_EXCHANGE emulation in every
+	// directory
+	if isExchangeTmpName(filepath.Base(path)) {
 		return true
 	}
 	// Note: gocryptfs.diriv is NOT forbidden because diriv and plaintextnames
@@ -38,7 +71,7 @@ func (volume *Volume) prepareAtSyscall(path string) (dirfd int, cName string, er
 	}
 
 	if volume.isFiltered(path) {
-		return -1, "", nil
+		return -1, "", syscall.EPERM
 	}
 
 	var encryptName func(int, string, []byte) (string, error)
@@ -145,6 +178,20 @@ func (volume *Volume) decryptSymlinkTarget(cData64 string) (string, error) {
 	return string(data), nil
 }
 
+// encryptSymlinkTarget: "data" is encrypted like file contents (GCM)
+// and base64-encoded.
+// The empty string encrypts to the empty string.
+//
+// Symlink-safe because it does not do any I/O.
+func (volume *Volume) encryptSymlinkTarget(data string) (cData64 string) {
+	if data == "" {
+		return ""
+	}
+	cData := volume.contentEnc.EncryptBlock([]byte(data), 0, nil)
+	cData64 = volume.nameTransform.B64EncodeToString(cData)
+	return cData64
+}
+
 // readlink reads and decrypts a symlink. Used by Readlink, Getattr, Lookup.
 func (volume *Volume) readlink(dirfd int, cName string) []byte {
 	cTarget, err := syscallcompat.Readlinkat(dirfd, cName)
@@ -162,6 +209,16 @@ func (volume *Volume) readlink(dirfd int, cName string) []byte {
 	return []byte(target)
 }
 
+// cIntArray copies "values" into a malloc()ed C array. The host has to free it.
+func cIntArray(values []uint32) *C.int {
+	p := allocator.Malloc(len(values))
+	for i := range values {
+		offset := C.sizeof_int * uintptr(i)
+		*(*C.int)(unsafe.Pointer(uintptr(p) + offset)) = (C.int)(values[i])
+	}
+	return (*C.int)(p)
+}
+
 func isRegular(mode uint32) bool { return (mode & syscall.S_IFMT) == syscall.S_IFREG }
 
 func isSymlink(mode uint32) bool { return (mode & syscall.S_IFMT) == syscall.S_IFLNK }
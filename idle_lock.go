@@ -0,0 +1,126 @@
+package main
+
+import (
+	"C"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// idleLock holds the state needed to automatically lock a volume after a
+// period without API calls.
+type idleLock struct {
+	sync.Mutex
+	// Time without API calls after which the volume is locked.
+	timeout time.Duration
+	// Time of the last API call in Unix nanoseconds. Accessed atomically.
+	lastActivity int64
+	// timer is nil when idle locking is disabled.
+	timer *time.Timer
+	// Host function called after the volume has been locked
+	callback unsafe.Pointer
+}
+
+// touch records API activity on the volume.
+func (volume *Volume) touch() {
+	atomic.StoreInt64(&volume.idleLock.lastActivity, time.Now().UnixNano())
+}
+
+// stopIdleTimer disables idle locking.
+func (volume *Volume) stopIdleTimer() {
+	l := &volume.idleLock
+	l.Lock()
+	defer l.Unlock()
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+}
+
+// checkIdle is called by the idle timer. It locks the volume if it has not
+// been used for l.timeout, otherwise it re-arms the timer.
+func (volume *Volume) checkIdle() {
+	l := &volume.idleLock
+	l.Lock()
+	if l.timer == nil {
+		// Idle locking was disabled in the meantime
+		l.Unlock()
+		return
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&l.lastActivity)))
+	if volume.ops.busy() {
+		l.timer.Reset(l.timeout)
+		l.Unlock()
+		return
+	}
+	if idle < l.timeout {
+		l.timer.Reset(l.timeout - idle)
+		l.Unlock()
+		return
+	}
+	l.Unlock()
+	volume.lock()
+}
+
+// lock closes the volume like gcf_close and notifies the host through the
+// lock callback.
+func (volume *Volume) lock() bool {
+	volume.idleLock.Lock()
+	callback := volume.idleLock.callback
+	volume.idleLock.Unlock()
+	_, ok := volume.close(-1, false)
+	if ok {
+		callLockCallback(callback, volume.volumeID)
+	}
+	return ok
+}
+
+// gcf_set_idle_timeout locks the volume after "timeoutSec" seconds without
+// API calls. A timeout <= 0 disables idle locking.
+//
+// Locking closes all file handles, wipes the keys and unregisters the volume
+// like gcf_close. Then "callback", a "void (*)(int volumeID)" function, is
+// called (from a thread not created by the host) so that the host can ask for
+// the password again. "callback" may be NULL.
+//
+//export gcf_set_idle_timeout
+func gcf_set_idle_timeout(volumeID int, timeoutSec int, callback unsafe.Pointer) bool {
+	volume, ok := acquireVolume(volumeID)
+	if !ok {
+		return false
+	}
+	defer volume.release()
+	l := &volume.idleLock
+	l.Lock()
+	defer l.Unlock()
+	l.callback = callback
+	if timeoutSec <= 0 {
+		if l.timer != nil {
+			l.timer.Stop()
+			l.timer = nil
+		}
+		return true
+	}
+	l.timeout = time.Duration(timeoutSec) * time.Second
+	if l.timer == nil {
+		l.timer = time.AfterFunc(l.timeout, volume.checkIdle)
+	} else {
+		l.timer.Reset(l.timeout)
+	}
+	return true
+}
+
+// gcf_lock immediately locks the volume, as if the idle timeout had expired.
+// It waits for the in-flight operations to return. When called from a
+// progress or walk callback of an operation on the same volume, it can't wait
+// for that operation and returns false without locking.
+//
+//export gcf_lock
+func gcf_lock(volumeID int) bool {
+	value, ok := OpenedVolumes.Load(volumeID)
+	if !ok {
+		return false
+	}
+	return value.(*Volume).lock()
+}
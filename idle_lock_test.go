@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// waitClosed polls until the volume is closed or "timeout" expired.
+func waitClosed(volumeID int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !gcf_is_closed(volumeID) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return true
+}
+
+func TestIdleTimeout(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	if !gcf_set_idle_timeout(volumeID, 1, nil) {
+		t.Fatal("gcf_set_idle_timeout failed")
+	}
+	// Activity pushes the deadline back
+	time.Sleep(600 * time.Millisecond)
+	gcf_mkdir(volumeID, "/d", 0700)
+	time.Sleep(600 * time.Millisecond)
+	if gcf_is_closed(volumeID) {
+		t.Fatal("locked although the volume was used")
+	}
+	if !waitClosed(volumeID, 2*time.Second) {
+		t.Fatal("not locked after the idle timeout")
+	}
+}
+
+func TestIdleTimeoutBusy(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	gcf_set_idle_timeout(volumeID, 1, nil)
+	volume, _ := acquireVolume(volumeID)
+	time.Sleep(1500 * time.Millisecond)
+	if gcf_is_closed(volumeID) {
+		t.Fatal("locked during an operation")
+	}
+	volume.release()
+	if !waitClosed(volumeID, 2*time.Second) {
+		t.Fatal("not locked after the operation returned")
+	}
+}
+
+func TestIdleTimeoutDisable(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	gcf_set_idle_timeout(volumeID, 1, nil)
+	gcf_set_idle_timeout(volumeID, 0, nil)
+	time.Sleep(1500 * time.Millisecond)
+	if gcf_is_closed(volumeID) {
+		t.Fatal("locked after disabling the idle timeout")
+	}
+	if !gcf_lock(volumeID) || !gcf_is_closed(volumeID) {
+		t.Fatal("gcf_lock failed")
+	}
+	if gcf_lock(volumeID) {
+		t.Fatal("locked a closed volume")
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"C"
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"libgocryptfs/v2/internal/syscallcompat"
+)
+
+const (
+	// indexFileName is the name index in the root of the ciphertext
+	// directory. Its content is encrypted like file contents.
+	indexFileName = "gocryptfs.index"
+	// indexVersion is stored in the index and checked on load
+	indexVersion = 1
+	// indexSaveDelay is how long changes are batched before the index is
+	// written to disk.
+	indexSaveDelay = 5 * time.Second
+)
+
+// indexEntry describes a file, directory or symlink in the index.
+type indexEntry struct {
+	// Path is the plaintext path, starting with "/"
+	Path string
+	Mode uint32
+	// Size is the plaintext size
+	Size  uint64
+	Mtime uint64
+	// CName is the name on disk
+	CName string
+}
+
+// indexFile is what is stored in indexFileName.
+type indexFile struct {
+	Version int
+	Entries []*indexEntry
+}
+
+// nameIndex is the in-memory copy of the name index. It is updated by the
+// operations that create, rename or delete entries and saved after
+// indexSaveDelay, and when the volume is closed.
+//
+// The index only reflects changes made through libgocryptfs. Changes made
+// behind our back (sync tools, another gocryptfs mount...) require a rebuild.
+type nameIndex struct {
+	sync.Mutex
+	// entries is nil if the index is disabled
+	entries map[string]*indexEntry
+	// dirty is set if entries has not been saved yet
+	dirty     bool
+	saveTimer *time.Timer
+}
+
+// loadIndex loads the index from disk, if the volume has one. The index stays
+// disabled if it can't be read.
+func (volume *Volume) loadIndex() error {
+	dirfd, _, err := volume.prepareAtSyscallMyself("/")
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	data, err := volume.readEncryptedFile(dirfd, indexFileName)
+	if err != nil {
+		return err
+	}
+	var f indexFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	if f.Version != indexVersion {
+		return errors.New("unsupported index version")
+	}
+	entries := make(map[string]*indexEntry, len(f.Entries))
+	for _, e := range f.Entries {
+		entries[e.Path] = e
+	}
+	volume.index.Lock()
+	volume.index.entries = entries
+	volume.index.dirty = false
+	volume.index.Unlock()
+	return nil
+}
+
+// saveIndex writes the index to disk if it changed.
+func (volume *Volume) saveIndex() error {
+	volume.index.Lock()
+	if volume.index.entries == nil || !volume.index.dirty {
+		volume.index.Unlock()
+		return nil
+	}
+	f := indexFile{
+		Version: indexVersion,
+		Entries: make([]*indexEntry, 0, len(volume.index.entries)),
+	}
+	for _, e := range volume.index.entries {
+		f.Entries = append(f.Entries, e)
+	}
+	data, err := json.Marshal(&f)
+	volume.index.dirty = false
+	volume.index.Unlock()
+	if err == nil {
+		var dirfd int
+		dirfd, _, err = volume.prepareAtSyscallMyself("/")
+		if err == nil {
+			err = volume.writeEncryptedFile(dirfd, indexFileName, data)
+			syscall.Close(dirfd)
+		}
+	}
+	if err != nil {
+		// Try again next time
+		volume.index.Lock()
+		volume.index.dirty = true
+		volume.index.Unlock()
+	}
+	return err
+}
+
+// scheduleIndexSave marks the index as modified and arms the save timer.
+// Must be called with volume.index locked.
+func (volume *Volume) scheduleIndexSave() {
+	volume.index.dirty = true
+	if volume.index.saveTimer != nil {
+		return
+	}
+	volume.index.saveTimer = time.AfterFunc(indexSaveDelay, func() {
+		volume.index.Lock()
+		volume.index.saveTimer = nil
+		volume.index.Unlock()
+		// The keys are needed, don't race with gcf_close. It flushes the
+		// index itself.
+		if volume.ops.begin() {
+			volume.saveIndex()
+			volume.ops.end()
+		}
+	})
+}
+
+// flushIndex stops the save timer and saves the index. Called when the
+// volume is closed.
+func (volume *Volume) flushIndex() {
+	volume.index.Lock()
+	if volume.index.saveTimer != nil {
+		volume.index.saveTimer.Stop()
+		volume.index.saveTimer = nil
+	}
+	volume.index.Unlock()
+	volume.saveIndex()
+}
+
+// indexEnabled tells if the volume has an index.
+func (volume *Volume) indexEnabled() bool {
+	volume.index.Lock()
+	defer volume.index.Unlock()
+	return volume.index.entries != nil
+}
+
+// indexUpdate adds or refreshes the index entry of "relPath".
+func (volume *Volume) indexUpdate(relPath string) {
+	if !volume.indexEnabled() {
+		return
+	}
+	dirfd, cName, err := volume.prepareAtSyscall(relPath)
+	if err != nil {
+		return
+	}
+	defer syscall.Close(dirfd)
+	volume.indexUpdateAt(relPath, dirfd, cName)
+}
+
+// indexUpdateAt is like indexUpdate for the entry "cName" in "dirfd".
+func (volume *Volume) indexUpdateAt(relPath string, dirfd int, cName string) {
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return
+	}
+	relPath = path.Clean("/" + relPath)
+	e := &indexEntry{
+		Path:  relPath,
+		Mode:  st.Mode,
+		Size:  volume.translateSize(dirfd, cName, st),
+		Mtime: uint64(st.Mtim.Sec),
+		CName: cName,
+	}
+	volume.index.Lock()
+	defer volume.index.Unlock()
+	if volume.index.entries == nil {
+		return
+	}
+	volume.index.entries[relPath] = e
+	volume.scheduleIndexSave()
+}
+
+// indexRemove removes "relPath" and everything below from the index.
+func (volume *Volume) indexRemove(relPath string) {
+	volume.index.Lock()
+	defer volume.index.Unlock()
+	if volume.index.remove(path.Clean("/" + relPath)) {
+		volume.scheduleIndexSave()
+	}
+}
+
+// remove removes "relPath" and everything below. Returns false if there was
+// nothing to remove. Must be called with the lock held.
+func (idx *nameIndex) remove(relPath string) bool {
+	e, ok := idx.entries[relPath]
+	if !ok {
+		return false
+	}
+	delete(idx.entries, relPath)
+	if e.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		prefix := relPath + "/"
+		for p := range idx.entries {
+			if strings.HasPrefix(p, prefix) {
+				delete(idx.entries, p)
+			}
+		}
+	}
+	return true
+}
+
+// indexRename moves the entries of "oldPath" (and everything below) to
+// "newPath". With "exchange", the entries of "newPath" move to "oldPath".
+func (volume *Volume) indexRename(oldPath, newPath string, exchange bool) {
+	oldPath = path.Clean("/" + oldPath)
+	newPath = path.Clean("/" + newPath)
+	volume.index.Lock()
+	entries := volume.index.entries
+	if entries == nil {
+		volume.index.Unlock()
+		return
+	}
+	if !exchange {
+		// Overwritten
+		volume.index.remove(newPath)
+	}
+	var moved, exchanged []*indexEntry
+	for p, e := range entries {
+		if p == oldPath || strings.HasPrefix(p, oldPath+"/") {
+			moved = append(moved, e)
+			delete(entries, p)
+		} else if exchange && (p == newPath || strings.HasPrefix(p, newPath+"/")) {
+			exchanged = append(exchanged, e)
+			delete(entries, p)
+		}
+	}
+	for _, e := range moved {
+		e.Path = newPath + strings.TrimPrefix(e.Path, oldPath)
+		entries[e.Path] = e
+	}
+	for _, e := range exchanged {
+		e.Path = oldPath + strings.TrimPrefix(e.Path, newPath)
+		entries[e.Path] = e
+	}
+	volume.scheduleIndexSave()
+	volume.index.Unlock()
+	// The names on disk changed
+	volume.indexUpdate(newPath)
+	if exchange {
+		volume.indexUpdate(oldPath)
+	}
+}
+
+// rebuildIndex scans the whole volume, replaces the index and saves it.
+// "progress" is called with the number of entries scanned so far, "total"
+// is unknown and always 0.
+func (volume *Volume) rebuildIndex(progress progressFunc) error {
+	entries := make(map[string]*indexEntry)
+	err := volume.walkTree("/", func(e *walkEntry) error {
+		size, mtime, err := volume.entryAttrs(e)
+		if err != nil {
+			return nil
+		}
+		entries[e.path] = &indexEntry{
+			Path:  e.path,
+			Mode:  e.mode,
+			Size:  size,
+			Mtime: mtime,
+			CName: e.cName,
+		}
+		if len(entries)%1000 == 0 && !progress(uint64(len(entries)), 0) {
+			return syscall.ECANCELED
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+	volume.index.Lock()
+	volume.index.entries = entries
+	volume.index.dirty = true
+	volume.index.Unlock()
+	progress(uint64(len(entries)), uint64(len(entries)))
+	return volume.saveIndex()
+}
+
+// deleteIndex disables the index and deletes it from disk.
+func (volume *Volume) deleteIndex() error {
+	volume.index.Lock()
+	volume.index.entries = nil
+	volume.index.dirty = false
+	if volume.index.saveTimer != nil {
+		volume.index.saveTimer.Stop()
+		volume.index.saveTimer = nil
+	}
+	volume.index.Unlock()
+	dirfd, _, err := volume.prepareAtSyscallMyself("/")
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	err = syscallcompat.Unlinkat(dirfd, indexFileName, 0)
+	if err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// indexSearch returns the paths of the index entries matching "q" at most
+// "limit" of them (no limit if 0), sorted by path.
+func (volume *Volume) indexSearch(q *searchQuery, limit int) ([]string, error) {
+	volume.index.Lock()
+	defer volume.index.Unlock()
+	if volume.index.entries == nil {
+		return nil, syscall.ENOENT
+	}
+	var results []string
+	for p, e := range volume.index.entries {
+		if q.matchName(path.Base(p)) && q.matchAttrs(e.Mode, e.Size, e.Mtime) {
+			results = append(results, p)
+		}
+	}
+	sort.Strings(results)
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// indexRecent returns the paths of the "limit" most recently modified
+// regular files.
+func (volume *Volume) indexRecent(limit int) ([]string, error) {
+	volume.index.Lock()
+	defer volume.index.Unlock()
+	if volume.index.entries == nil {
+		return nil, syscall.ENOENT
+	}
+	var files []*indexEntry
+	for _, e := range volume.index.entries {
+		if isRegular(e.Mode) {
+			files = append(files, e)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Mtime != files[j].Mtime {
+			return files[i].Mtime > files[j].Mtime
+		}
+		return files[i].Path < files[j].Path
+	})
+	if limit > 0 && len(files) > limit {
+		files = files[:limit]
+	}
+	results := make([]string, len(files))
+	for i := range files {
+		results[i] = files[i].Path
+	}
+	return results, nil
+}
+
+// pathList returns "paths" as a NUL-separated C string and their number.
+func pathList(paths []string) (*C.char, C.int) {
+	var list strings.Builder
+	for _, p := range paths {
+		list.WriteString(p + "\x00")
+	}
+	return C.CString(list.String()), C.int(len(paths))
+}
+
+// gcf_index_rebuild creates or rebuilds the name index of the volume by
+// scanning all directories. The index is stored encrypted in the ciphertext
+// directory as "gocryptfs.index", loaded when the volume is opened and kept
+// up to date by the operations of this library. Changes made by other
+// programs (sync tools, gocryptfs mounts...) are only picked up by a rebuild.
+//
+// "progressCallback" may be NULL. Otherwise it is called like in
+// gcf_copy_file, with the number of entries scanned so far and a total of 0
+// until the scan is finished. Returning non-zero aborts the rebuild, the
+// previous index is kept.
+//
+//export gcf_index_rebuild
+func gcf_index_rebuild(sessionID int, progressCallback unsafe.Pointer) bool {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return false
+	}
+	defer volume.release()
+	return errToBool(volume.rebuildIndex(hostProgress(progressCallback, sessionID)))
+}
+
+// gcf_index_delete disables the name index and deletes it.
+//
+//export gcf_index_delete
+func gcf_index_delete(sessionID int) bool {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return false
+	}
+	defer volume.release()
+	return errToBool(volume.deleteIndex())
+}
+
+// gcf_index_search is like gcf_search but answers from the name index
+// instead of scanning the directories. The paths are sorted.
+//
+// Returns NULL and -1 on error or if the volume has no index.
+//
+//export gcf_index_search
+func gcf_index_search(sessionID int, pattern string, glob bool, minSize, maxSize, minMtime, maxMtime uint64, limit int) (*C.char, C.int) {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return nil, -1
+	}
+	defer volume.release()
+	q, err := newSearchQuery(pattern, glob, minSize, maxSize, minMtime, maxMtime)
+	if err != nil {
+		return nil, -1
+	}
+	results, err := volume.indexSearch(q, limit)
+	if err != nil {
+		return nil, -1
+	}
+	return pathList(results)
+}
+
+// gcf_index_recent returns the "limit" most recently modified regular files
+// according to the name index (all of them if "limit" is 0), newest first, as
+// a NUL-separated list, and their number.
+//
+// Returns NULL and -1 on error or if the volume has no index.
+//
+//export gcf_index_recent
+func gcf_index_recent(sessionID int, limit int) (*C.char, C.int) {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return nil, -1
+	}
+	defer volume.release()
+	results, err := volume.indexRecent(limit)
+	if err != nil {
+		return nil, -1
+	}
+	return pathList(results)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"libgocryptfs/v2/internal/syscallcompat"
+)
+
+// indexPaths returns all paths in the index of "volumeID", sorted.
+func indexPaths(t *testing.T, volumeID int) string {
+	t.Helper()
+	q, _ := newSearchQuery("", false, 0, 0, 0, 0)
+	paths, err := getVolume(t, volumeID).indexSearch(q, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(paths, ",")
+}
+
+func TestIndex(t *testing.T) {
+	dir, volumeID := newTestVolume(t)
+	gcf_mkdir(volumeID, "/a", 0700)
+	writeTestFile(t, volumeID, "/a/old.txt", []byte("x"))
+	if _, n := gcf_index_search(volumeID, "", false, 0, 0, 0, 0, 0); n != -1 {
+		t.Fatal("searched a missing index")
+	}
+	if !gcf_index_rebuild(volumeID, nil) {
+		t.Fatal("gcf_index_rebuild failed")
+	}
+	if got := indexPaths(t, volumeID); got != "/a,/a/old.txt" {
+		t.Fatalf("rebuilt index: %s", got)
+	}
+	// The index file is hidden
+	entries, _ := getVolume(t, volumeID).listDir("/", true)
+	if len(entries) != 1 {
+		t.Errorf("listing: %v", entries)
+	}
+
+	// Changes through the library update the index
+	gcf_mkdir(volumeID, "/b", 0700)
+	writeTestFile(t, volumeID, "/b/new.jpg", []byte("hello"))
+	writeTestFile(t, volumeID, "/b/x", nil)
+	gcf_rename(volumeID, "/a", "/c")
+	gcf_remove_file(volumeID, "/c/old.txt")
+	gcf_rename_flags(volumeID, "/b/x", "/c", syscallcompat.RENAME_EXCHANGE)
+	if got := indexPaths(t, volumeID); got != "/b,/b/new.jpg,/b/x,/c" {
+		t.Fatalf("updated index: %s", got)
+	}
+	volume := getVolume(t, volumeID)
+	if e := volume.index.entries["/b/new.jpg"]; e.Size != 5 || !isRegular(e.Mode) {
+		t.Errorf("entry: %+v", e)
+	}
+	if !isRegular(volume.index.entries["/c"].Mode) {
+		t.Error("exchanged entry keeps its old mode")
+	}
+	if _, n := gcf_index_search(volumeID, "*.jpg", true, 0, 0, 0, 0, 0); n != 1 {
+		t.Errorf("gcf_index_search found %d paths", n)
+	}
+	if recent, _ := volume.indexRecent(1); len(recent) != 1 {
+		t.Errorf("recent: %v", recent)
+	}
+	gcf_remove_recursive(volumeID, "/b", nil)
+	if got := indexPaths(t, volumeID); got != "/c" {
+		t.Fatalf("after recursive remove: %s", got)
+	}
+
+	// Closing saves the pending changes
+	gcf_close_volume(volumeID, 1000, false)
+	volumeID = openTestVolume(t, dir)
+	if got := indexPaths(t, volumeID); got != "/c" {
+		t.Fatalf("reloaded index: %s", got)
+	}
+
+	if !gcf_index_delete(volumeID) {
+		t.Fatal("gcf_index_delete failed")
+	}
+	if _, n := gcf_index_search(volumeID, "", false, 0, 0, 0, 0, 0); n != -1 {
+		t.Error("searched a deleted index")
+	}
+	if _, err := os.Stat(filepath.Join(dir, indexFileName)); !os.IsNotExist(err) {
+		t.Error("index file not deleted")
+	}
+}
+
+// A damaged index file leaves the index disabled instead of failing to open
+// the volume.
+func TestIndexDamaged(t *testing.T) {
+	dir, volumeID := newTestVolume(t)
+	gcf_index_rebuild(volumeID, nil)
+	gcf_close_volume(volumeID, 1000, false)
+	os.WriteFile(filepath.Join(dir, indexFileName), []byte("garbage"), 0600)
+
+	volumeID = openTestVolume(t, dir)
+	if _, n := gcf_index_search(volumeID, "", false, 0, 0, 0, 0, 0); n != -1 {
+		t.Error("damaged index used")
+	}
+	if !gcf_index_rebuild(volumeID, nil) {
+		t.Error("can't rebuild a damaged index")
+	}
+}
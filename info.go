@@ -0,0 +1,131 @@
+package main
+
+import (
+	"C"
+	"encoding/json"
+	"path/filepath"
+
+	"libgocryptfs/v2/internal/configfile"
+	"libgocryptfs/v2/internal/contentenc"
+	"libgocryptfs/v2/internal/cryptocore"
+	"libgocryptfs/v2/internal/nametransform"
+)
+
+// volumeInfo is returned as JSON by gcf_volume_info and
+// gcf_opened_volume_info.
+type volumeInfo struct {
+	// Creator is the program that created the volume, like "gocryptfs v2.4.0"
+	Creator string
+	// Version is the on-disk format version
+	Version      uint16
+	FeatureFlags []string
+	// ContentEncryption is the content encryption algorithm, like
+	// "AES-GCM-256"
+	ContentEncryption string
+	ScryptN           int
+	ScryptR           int
+	ScryptP           int
+	// LongNameMax is the length above which encrypted names are hashed
+	LongNameMax    int
+	PlaintextNames bool
+	// BlockSize is the plaintext block size, CipherBlockSize the size of
+	// the encrypted blocks on disk
+	BlockSize       uint64
+	CipherBlockSize uint64
+	FIDO2           bool
+
+	// The following fields are only set for opened volumes
+
+	// Backend is the selected implementation of the content encryption,
+	// like "AES-GCM-256-OpenSSL"
+	Backend         string   `json:",omitempty"`
+	VolumeID        *int     `json:",omitempty"`
+	RootCipherDir   string   `json:",omitempty"`
+	OpenFiles       *int     `json:",omitempty"`
+	IndexEnabled    *bool    `json:",omitempty"`
+	BadnamePatterns []string `json:",omitempty"`
+}
+
+// newVolumeInfo returns the information contained in the config file.
+func newVolumeInfo(cf *configfile.ConfFile) (*volumeInfo, error) {
+	algo, err := cf.ContentEncryption()
+	if err != nil {
+		return nil, err
+	}
+	longNameMax := int(cf.LongNameMax)
+	if longNameMax == 0 {
+		longNameMax = nametransform.NameMax
+	}
+	blockSize := uint64(contentenc.DefaultBS)
+	return &volumeInfo{
+		Creator:           cf.Creator,
+		Version:           cf.Version,
+		FeatureFlags:      cf.FeatureFlags,
+		ContentEncryption: algo.Algo,
+		ScryptN:           cf.ScryptObject.N,
+		ScryptR:           cf.ScryptObject.R,
+		ScryptP:           cf.ScryptObject.P,
+		LongNameMax:       longNameMax,
+		PlaintextNames:    cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		BlockSize:         blockSize,
+		CipherBlockSize:   blockSize + uint64(algo.NonceSize) + cryptocore.AuthTagLen,
+		FIDO2:             cf.IsFeatureFlagSet(configfile.FlagFIDO2),
+	}, nil
+}
+
+// infoJSON marshals "info" into a C string, or returns NULL.
+func infoJSON(info interface{}) *C.char {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil
+	}
+	return C.CString(string(data))
+}
+
+// gcf_volume_info returns information about the volume in "rootCipherDir" as
+// a JSON object, read from its config file without the password: creator,
+// on-disk version, feature flags, content encryption, scrypt parameters,
+// long name limit, plaintext names mode and block sizes. Returns NULL if the
+// config file can't be loaded. The host must free the returned string.
+//
+//export gcf_volume_info
+func gcf_volume_info(rootCipherDir string) *C.char {
+	cf, err := configfile.Load(filepath.Join(rootCipherDir, configfile.ConfDefaultName))
+	if err != nil {
+		return nil
+	}
+	info, err := newVolumeInfo(cf)
+	if err != nil {
+		return nil
+	}
+	return infoJSON(info)
+}
+
+// gcf_opened_volume_info is like gcf_volume_info for an opened volume, with
+// additional fields: the crypto backend actually in use, the volume ID, the
+// ciphertext directory, the number of open file handles, whether the name
+// index is enabled and the badname patterns.
+//
+//export gcf_opened_volume_info
+func gcf_opened_volume_info(sessionID int) *C.char {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return nil
+	}
+	defer volume.release()
+	info, err := newVolumeInfo(volume.conf)
+	if err != nil {
+		return nil
+	}
+	volume.handlesLock.RLock()
+	openFiles := len(volume.fileHandles)
+	volume.handlesLock.RUnlock()
+	indexEnabled := volume.indexEnabled()
+	info.Backend = volume.cryptoBackend.String()
+	info.VolumeID = &volume.volumeID
+	info.RootCipherDir = volume.rootCipherDir
+	info.OpenFiles = &openFiles
+	info.IndexEnabled = &indexEnabled
+	info.BadnamePatterns = volume.badname
+	return infoJSON(info)
+}
@@ -0,0 +1,80 @@
+package configfile
+
+import (
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+
+	"libgocryptfs/v2/internal/cryptocore"
+)
+
+// scryptMaxLogN is the highest logN CalibrateScrypt returns. logN=28 needs
+// 32 GiB of memory.
+const scryptMaxLogN = 28
+
+// ScryptCalibration is the result of CalibrateScrypt.
+type ScryptCalibration struct {
+	// LogN is the cost parameter to pass to NewScryptKDF
+	LogN int
+	// Memory is the memory scrypt needs with LogN, in bytes
+	Memory uint64
+	// Duration is the time one key derivation took with LogN
+	Duration time.Duration
+}
+
+// ScryptMemory returns the memory used by scrypt with "logN" and our fixed
+// R parameter: 128 * N * R bytes.
+func ScryptMemory(logN int) uint64 {
+	return 128 * (uint64(1) << uint(logN)) * scryptMinR
+}
+
+// ValidScryptLogN tells if "logN" is accepted by NewScryptKDF and DeriveKey.
+func ValidScryptLogN(logN int) bool {
+	return logN >= scryptMinLogN && logN <= scryptMaxLogN
+}
+
+// CalibrateScrypt finds the highest logN whose key derivation takes at most
+// "target" on this device and needs at most "maxMemory" bytes (0 means no
+// limit). It starts at the minimum logN and doubles N as long as the
+// previous measurement leaves room for it, so it runs for about 2*"target".
+//
+// The minimum logN is returned even if it is slower than "target" or needs
+// more than "maxMemory".
+func CalibrateScrypt(target time.Duration, maxMemory uint64) ScryptCalibration {
+	pw := make([]byte, 16)
+	salt := cryptocore.RandBytes(scryptMinSaltLen)
+	measure := func(logN int) time.Duration {
+		start := time.Now()
+		k, _ := scrypt.Key(pw, salt, 1<<uint(logN), scryptMinR, scryptMinP, cryptocore.KeyLen)
+		d := time.Since(start)
+		for i := range k {
+			k[i] = 0
+		}
+		return d
+	}
+	res := ScryptCalibration{
+		LogN:     scryptMinLogN,
+		Memory:   ScryptMemory(scryptMinLogN),
+		Duration: measure(scryptMinLogN),
+	}
+	for res.LogN < scryptMaxLogN {
+		next := res.LogN + 1
+		// Doubling N doubles the time
+		if 2*res.Duration > target {
+			break
+		}
+		if maxMemory > 0 && ScryptMemory(next) > maxMemory {
+			break
+		}
+		d := measure(next)
+		if d > target {
+			break
+		}
+		res = ScryptCalibration{
+			LogN:     next,
+			Memory:   ScryptMemory(next),
+			Duration: d,
+		}
+	}
+	return res
+}
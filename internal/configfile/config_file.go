@@ -3,8 +3,11 @@
 package configfile
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"syscall"
 
@@ -13,6 +16,7 @@ import (
 	"libgocryptfs/v2/internal/contentenc"
 	"libgocryptfs/v2/internal/cryptocore"
 	"libgocryptfs/v2/internal/exitcodes"
+	"libgocryptfs/v2/internal/securemem"
 )
 
 const (
@@ -24,6 +28,12 @@ const (
 	// the config file gets stored next to the plain-text files. Make it hidden
 	// (start with dot) to not annoy the user.
 	ConfReverseName = ".gocryptfs.reverse.conf"
+	// ConfBackupName is the name of the copy of the config file that
+	// WriteFile keeps next to it, to recover from a deleted or corrupted
+	// config file.
+	ConfBackupName = ConfDefaultName + backupSuffix
+
+	backupSuffix = ".bak"
 )
 
 // FIDO2Params is a structure for storing FIDO2 parameters.
@@ -56,6 +66,13 @@ type ConfFile struct {
 	FIDO2 *FIDO2Params `json:",omitempty"`
 	// LongNameMax corresponds to the -longnamemax flag
 	LongNameMax uint8 `json:",omitempty"`
+	// ConfigMAC authenticates the other fields with a key derived from the
+	// master key, see config_mac.go. Missing in configs written by gocryptfs
+	// and older libgocryptfs versions.
+	ConfigMAC []byte `json:",omitempty"`
+	// RecoveryRecipients hold copies of the master key encrypted to recovery
+	// keys, see recovery.go
+	RecoveryRecipients []RecoveryRecipient `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
 }
@@ -110,6 +127,8 @@ func Create(args *CreateArgs, returnedScryptHashBuff []byte) error {
 	if args.AESSIV {
 		cf.setFeatureFlag(FlagAESSIV)
 	}
+	// New configs always require their MAC. gocryptfs can't mount them.
+	cf.setFeatureFlag(FlagConfigMAC)
 	// Catch bugs and invalid cli flag combinations early
 	cf.ScryptObject = NewScryptKDF(args.LogN)
 	if err := cf.Validate(); err != nil {
@@ -121,32 +140,43 @@ func Create(args *CreateArgs, returnedScryptHashBuff []byte) error {
 		return err
 	}
 	{
-		// Generate new random master key
-		key := cryptocore.RandBytes(cryptocore.KeyLen)
+		key, err := newMasterkey()
+		if err != nil {
+			return err
+		}
 		// Encrypt it using the password
 		// This sets ScryptObject and EncryptedKey
 		// Note: this looks at the FeatureFlags, so call it AFTER setting them.
-		scryptHash := cf.EncryptKey(key, args.Password, args.LogN, len(returnedScryptHashBuff) > 0)
-		for i := range key {
-			key[i] = 0
-		}
-		for i := range scryptHash {
-			returnedScryptHashBuff[i] = scryptHash[i]
-			scryptHash[i] = 0
+		scryptHash := cf.EncryptKey(key.Bytes(), args.Password, args.LogN, len(returnedScryptHashBuff) > 0)
+		cf.SetMAC(key.Bytes())
+		key.Destroy()
+		if scryptHash != nil {
+			cf.CopyScryptHash(returnedScryptHashBuff, scryptHash.Bytes())
+			scryptHash.Destroy()
 		}
-		// key runs out of scope here
 	}
 	// Write file to disk
 	return cf.WriteFile()
 }
 
+// newMasterkey generates a new random master key directly into locked memory.
+// The caller must Destroy() it.
+func newMasterkey() (*securemem.Buffer, error) {
+	key := securemem.New(cryptocore.KeyLen)
+	if _, err := io.ReadFull(rand.Reader, key.Bytes()); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+	return key, nil
+}
+
 // LoadAndDecrypt - read config file from disk and decrypt the
 // contained key using "password".
 // Returns the decrypted key and the ConfFile object
 //
 // If "password" is empty, the config file is read
 // but the key is not decrypted (returns nil in its place).
-func LoadAndDecrypt(filename string, password []byte) ([]byte, *ConfFile, error) {
+func LoadAndDecrypt(filename string, password []byte) (*securemem.Buffer, *ConfFile, error) {
 	cf, err := Load(filename)
 	if err != nil {
 		return nil, nil, err
@@ -170,20 +200,37 @@ func LoadAndDecrypt(filename string, password []byte) ([]byte, *ConfFile, error)
 
 // Load loads and parses the config file at "filename".
 func Load(filename string) (*ConfFile, error) {
-	var cf ConfFile
-	cf.filename = filename
-
 	// Read from disk
 	js, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	return Parse(js, filename)
+}
+
+// LoadBackup loads and parses the backup of the config file at "filename".
+// The returned ConfFile writes to "filename", so calling WriteFile on it
+// restores the config file.
+func LoadBackup(filename string) (*ConfFile, error) {
+	js, err := ioutil.ReadFile(filename + backupSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(js, filename)
+}
+
+// Parse parses the config file content "js". WriteFile will write to
+// "filename".
+func Parse(js []byte, filename string) (*ConfFile, error) {
+	var cf ConfFile
+	cf.filename = filename
+
 	if len(js) == 0 {
 		return nil, fmt.Errorf("Config file is empty")
 	}
 
 	// Unmarshal
-	err = json.Unmarshal(js, &cf)
+	err := json.Unmarshal(js, &cf)
 	if err != nil {
 		return nil, err
 	}
@@ -205,11 +252,13 @@ func (cf *ConfFile) setFeatureFlag(flag flagIota) {
 }
 
 // libgocryptfs function to allow masterkey to be directely decrypted using the scrypt hash
-func (cf *ConfFile) DecryptMasterKeyWithScryptHash(scryptHash []byte) ([]byte, error) {
+//
+// The masterkey is returned in locked memory, the caller must Destroy() it.
+func (cf *ConfFile) DecryptMasterKeyWithScryptHash(scryptHash []byte) (*securemem.Buffer, error) {
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
 
-	masterkey, err := ce.DecryptBlock(cf.EncryptedKey, 0, nil)
+	key, err := ce.DecryptBlock(cf.EncryptedKey, 0, cf.keyBinding())
 
 	ce.Wipe()
 	ce = nil
@@ -218,23 +267,26 @@ func (cf *ConfFile) DecryptMasterKeyWithScryptHash(scryptHash []byte) ([]byte, e
 		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
 	}
 
-	return masterkey, nil
+	// The decrypted key lives in a pooled heap buffer. Move it out and zero
+	// the buffer.
+	return securemem.Move(key), nil
 }
 
 // DecryptMasterKey decrypts the masterkey stored in cf.EncryptedKey using
 // password.
-func (cf *ConfFile) DecryptMasterKey(password []byte, giveHash bool) (masterkey, scryptHash []byte, err error) {
+//
+// Both returned buffers are in locked memory and must be Destroy()ed by the
+// caller. scryptHash is nil unless giveHash is set.
+func (cf *ConfFile) DecryptMasterKey(password []byte, giveHash bool) (masterkey, scryptHash *securemem.Buffer, err error) {
 	// Generate derived key from password
 	scryptHash = cf.ScryptObject.DeriveKey(password)
 
 	// Unlock master key using password-based key
-	masterkey, err = cf.DecryptMasterKeyWithScryptHash(scryptHash)
+	masterkey, err = cf.DecryptMasterKeyWithScryptHash(scryptHash.Bytes())
 
 	if !giveHash {
 		// Purge scrypt-derived key
-		for i := range scryptHash {
-			scryptHash[i] = 0
-		}
+		scryptHash.Destroy()
 		scryptHash = nil
 	}
 
@@ -245,21 +297,22 @@ func (cf *ConfFile) DecryptMasterKey(password []byte, giveHash bool) (masterkey,
 // and store it in cf.EncryptedKey.
 // Uses scrypt with cost parameter logN and stores the scrypt parameters in
 // cf.ScryptObject.
-func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int, giveHash bool) []byte {
+//
+// If giveHash is set, the scrypt hash is returned in locked memory and must be
+// Destroy()ed by the caller. Otherwise nil is returned.
+func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int, giveHash bool) *securemem.Buffer {
 	// Generate scrypt-derived key from password
 	cf.ScryptObject = NewScryptKDF(logN)
 	scryptHash := cf.ScryptObject.DeriveKey(password)
 
 	// Lock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
-	ce := getKeyEncrypter(scryptHash, useHKDF)
-	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	ce := getKeyEncrypter(scryptHash.Bytes(), useHKDF)
+	cf.EncryptedKey = ce.EncryptBlock(key, 0, cf.keyBinding())
 
 	if !giveHash {
 		// Purge scrypt-derived key
-		for i := range scryptHash {
-			scryptHash[i] = 0
-		}
+		scryptHash.Destroy()
 		scryptHash = nil
 	}
 	ce.Wipe()
@@ -268,44 +321,137 @@ func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int, giveHash b
 	return scryptHash
 }
 
-func (cf *ConfFile) GetMasterkey(password, givenScryptHash, returnedScryptHashBuff []byte) ([]byte, error) {
-	var masterkey []byte
+// GetMasterkey decrypts the masterkey either with "givenScryptHash", if not
+// empty, or with "password". In the latter case, the scrypt hash is copied to
+// "returnedScryptHashBuff" if it is not empty, in an envelope if the buffer
+// is ScryptHashEnvelopeLen bytes long (see hash_envelope.go).
+//
+// ErrStaleScryptHash is returned for an enveloped "givenScryptHash" derived
+// before the last password change, and for a raw one that does not decrypt
+// the masterkey, ErrConfigTampered if the config MAC does not match.
+//
+// The masterkey is returned in locked memory, the caller must Destroy() it.
+func (cf *ConfFile) GetMasterkey(password, givenScryptHash, returnedScryptHashBuff []byte) (*securemem.Buffer, error) {
+	return cf.GetMasterkeyNotify(password, givenScryptHash, returnedScryptHashBuff, nil)
+}
+
+// GetMasterkeyNotify is like GetMasterkey but calls "kdfDone", if not nil,
+// once the master key has been decrypted and before the config MAC is
+// checked. It is not called if decrypting fails.
+func (cf *ConfFile) GetMasterkeyNotify(password, givenScryptHash, returnedScryptHashBuff []byte, kdfDone func()) (*securemem.Buffer, error) {
+	verify := func(masterkey *securemem.Buffer) error {
+		if kdfDone != nil {
+			kdfDone()
+		}
+		return cf.verifyMasterkey(masterkey)
+	}
+	var masterkey *securemem.Buffer
 	var err error
 	if len(givenScryptHash) > 0 { //decrypt with hash
-		masterkey, err = cf.DecryptMasterKeyWithScryptHash(givenScryptHash)
-	} else { //decrypt with password
 		var scryptHash []byte
+		scryptHash, err = cf.openScryptHash(givenScryptHash)
+		if err != nil {
+			return nil, err
+		}
+		masterkey, err = cf.DecryptMasterKeyWithScryptHash(scryptHash)
+		if err == nil {
+			err = verify(masterkey)
+		} else if len(givenScryptHash) != ScryptHashEnvelopeLen {
+			// A raw hash carries no binding to tell a stale hash from a
+			// wrong one. Hashes are only handed out after a successful
+			// unlock, so one that stopped working is stale.
+			err = ErrStaleScryptHash
+		}
+	} else { //decrypt with password
+		var scryptHash *securemem.Buffer
 		masterkey, scryptHash, err = cf.DecryptMasterKey(password, len(returnedScryptHashBuff) > 0)
+		if err == nil {
+			err = verify(masterkey)
+		}
 		//copy and wipe scryptHash
-		for i := range scryptHash {
-			returnedScryptHashBuff[i] = scryptHash[i]
-			scryptHash[i] = 0
+		if scryptHash != nil {
+			if err == nil {
+				cf.CopyScryptHash(returnedScryptHashBuff, scryptHash.Bytes())
+			}
+			scryptHash.Destroy()
 		}
 	}
-	return masterkey, err
+	if err != nil {
+		return nil, err
+	}
+	return masterkey, nil
+}
+
+// verifyMasterkey checks the config MAC with the decrypted "masterkey", and
+// destroys it on mismatch.
+func (cf *ConfFile) verifyMasterkey(masterkey *securemem.Buffer) error {
+	err := cf.VerifyMAC(masterkey.Bytes())
+	if err != nil {
+		masterkey.Destroy()
+	}
+	return err
 }
 
 // WriteFile - write out config in JSON format to file "filename.tmp"
 // then rename over "filename".
 // This way a password change atomically replaces the file.
+//
+// The backup copy "filename.bak" is updated afterwards. Failing to do so is
+// not an error, as the config file itself has been written, and the backup
+// is refreshed by the next UpdateBackup.
 func (cf *ConfFile) WriteFile() error {
 	if err := cf.Validate(); err != nil {
 		return err
 	}
-	tmp := cf.filename + ".tmp"
-	// 0400 permissions: gocryptfs.conf should be kept secret and never be written to.
-	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	js, err := cf.Marshal()
 	if err != nil {
 		return err
 	}
-	js, err := json.MarshalIndent(cf, "", "\t")
+	if err = writeAtomic(cf.filename, js); err != nil {
+		return err
+	}
+	writeAtomic(cf.filename+backupSuffix, js)
+	return nil
+}
+
+// UpdateBackup writes the backup copy of the config file if it is missing or
+// differs from "cf". Call it only after the config file has been verified by
+// decrypting the master key, so that a tampered config file does not replace
+// a good backup.
+func (cf *ConfFile) UpdateBackup() error {
+	js, err := cf.Marshal()
 	if err != nil {
 		return err
 	}
+	backup, err := ioutil.ReadFile(cf.filename + backupSuffix)
+	if err == nil && bytes.Equal(backup, js) {
+		return nil
+	}
+	return writeAtomic(cf.filename+backupSuffix, js)
+}
+
+// Marshal returns the config file content.
+func (cf *ConfFile) Marshal() ([]byte, error) {
+	js, err := json.MarshalIndent(cf, "", "\t")
+	if err != nil {
+		return nil, err
+	}
 	// For convenience for the user, add a newline at the end.
-	js = append(js, '\n')
+	return append(js, '\n'), nil
+}
+
+// writeAtomic writes "js" to "filename.tmp" and renames it over "filename".
+func writeAtomic(filename string, js []byte) error {
+	tmp := filename + ".tmp"
+	// 0400 permissions: gocryptfs.conf should be kept secret and never be written to.
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
 	_, err = fd.Write(js)
 	if err != nil {
+		fd.Close()
+		os.Remove(tmp)
 		return err
 	}
 	err = fd.Sync()
@@ -317,10 +463,10 @@ func (cf *ConfFile) WriteFile() error {
 	}
 	err = fd.Close()
 	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
-	err = os.Rename(tmp, cf.filename)
-	return err
+	return os.Rename(tmp, filename)
 }
 
 // getKeyEncrypter is a helper function that returns the right ContentEnc
@@ -0,0 +1,126 @@
+package configfile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"libgocryptfs/v2/internal/cryptocore"
+	"libgocryptfs/v2/internal/securemem"
+)
+
+// ErrConfigTampered is returned by VerifyMAC when the config file has been
+// modified by someone who does not know the master key.
+var ErrConfigTampered = errors.New("config file authentication failed")
+
+// macInput holds the config fields covered by ConfigMAC. Creator is only
+// informational and not covered.
+type macInput struct {
+	EncryptedKey []byte
+	ScryptObject ScryptKDF
+	Version      uint16
+	FeatureFlags []string
+	FIDO2        *FIDO2Params
+	LongNameMax  uint8
+	// Omitted when empty to keep the MACs of older configs valid
+	RecoveryRecipients []RecoveryRecipient `json:",omitempty"`
+}
+
+// computeMAC returns the HMAC-SHA256 of the covered fields.
+func (cf *ConfFile) computeMAC(masterkey []byte) []byte {
+	data, err := json.Marshal(macInput{
+		EncryptedKey:       cf.EncryptedKey,
+		ScryptObject:       cf.ScryptObject,
+		Version:            cf.Version,
+		FeatureFlags:       cf.FeatureFlags,
+		FIDO2:              cf.FIDO2,
+		LongNameMax:        cf.LongNameMax,
+		RecoveryRecipients: cf.RecoveryRecipients,
+	})
+	if err != nil {
+		log.Panicf("computeMAC: %v", err)
+	}
+	key := cryptocore.ConfigMACKey(masterkey)
+	defer key.Destroy()
+	mac := hmac.New(sha256.New, key.Bytes())
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// SetMAC authenticates the config with "masterkey". Call it after changing any
+// field, before WriteFile.
+func (cf *ConfFile) SetMAC(masterkey []byte) {
+	cf.ConfigMAC = cf.computeMAC(masterkey)
+}
+
+// HasMAC tells if the config has been authenticated with SetMAC.
+func (cf *ConfFile) HasMAC() bool {
+	return len(cf.ConfigMAC) > 0
+}
+
+// VerifyMAC checks ConfigMAC with "masterkey". Returns ErrConfigTampered on
+// mismatch, or if the MAC is missing from a config with FlagConfigMAC.
+// Other configs without MAC pass, check HasMAC.
+func (cf *ConfFile) VerifyMAC(masterkey []byte) error {
+	if !cf.HasMAC() {
+		if cf.IsFeatureFlagSet(FlagConfigMAC) {
+			return ErrConfigTampered
+		}
+		return nil
+	}
+	if !hmac.Equal(cf.ConfigMAC, cf.computeMAC(masterkey)) {
+		return ErrConfigTampered
+	}
+	return nil
+}
+
+// macKeyBinding is the associated data of the encrypted master key of configs
+// with FlagConfigMAC. It has the length of a file ID, which is where
+// contentenc puts it.
+var macKeyBinding = []byte("libgocryptfs MAC")
+
+// keyBinding returns the associated data for encrypting the master key.
+func (cf *ConfFile) keyBinding() []byte {
+	if cf.IsFeatureFlagSet(FlagConfigMAC) {
+		return macKeyBinding
+	}
+	return nil
+}
+
+// RequireMAC migrates a config written by gocryptfs or older versions, which
+// must unlock with "password", or "givenScryptHash" if not empty, to one that
+// requires its MAC: FlagConfigMAC is set, the master key is encrypted again
+// bound to it, with the same scrypt hash, and the MAC is set. Configs that
+// already require a MAC are left unchanged. Call WriteFile afterwards.
+func (cf *ConfFile) RequireMAC(password, givenScryptHash []byte) error {
+	var scryptHash *securemem.Buffer
+	if len(givenScryptHash) > 0 {
+		raw, err := cf.openScryptHash(givenScryptHash)
+		if err != nil {
+			return err
+		}
+		scryptHash = securemem.Copy(raw)
+	} else {
+		scryptHash = cf.ScryptObject.DeriveKey(password)
+	}
+	defer scryptHash.Destroy()
+	masterkey, err := cf.DecryptMasterKeyWithScryptHash(scryptHash.Bytes())
+	if err != nil {
+		return err
+	}
+	defer masterkey.Destroy()
+	if err = cf.verifyMasterkey(masterkey); err != nil {
+		return err
+	}
+	if cf.IsFeatureFlagSet(FlagConfigMAC) {
+		return nil
+	}
+	cf.setFeatureFlag(FlagConfigMAC)
+	ce := getKeyEncrypter(scryptHash.Bytes(), cf.IsFeatureFlagSet(FlagHKDF))
+	cf.EncryptedKey = ce.EncryptBlock(masterkey.Bytes(), 0, cf.keyBinding())
+	ce.Wipe()
+	cf.SetMAC(masterkey.Bytes())
+	return nil
+}
@@ -0,0 +1,121 @@
+package configfile
+
+import (
+	"testing"
+)
+
+func TestConfigMACTamper(t *testing.T) {
+	cf := createTestConfig(t, "test", nil)
+	if !cf.HasMAC() {
+		t.Fatal("new config has no MAC")
+	}
+	tamper := map[string]func(c *ConfFile){
+		"LongNameMax": func(c *ConfFile) { c.LongNameMax = 100 },
+		"FeatureFlags": func(c *ConfFile) {
+			c.FeatureFlags = append([]string{}, c.FeatureFlags...)
+			c.FeatureFlags = append(c.FeatureFlags, knownFlags[FlagAESSIV])
+		},
+		"ScryptObject": func(c *ConfFile) { c.ScryptObject.N *= 2 },
+		"RecoveryRecipients": func(c *ConfFile) {
+			c.RecoveryRecipients = []RecoveryRecipient{{Label: "x"}}
+		},
+	}
+	masterkey, err := cf.GetMasterkey([]byte("test"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer masterkey.Destroy()
+	for name, f := range tamper {
+		c := *cf
+		f(&c)
+		if err := c.VerifyMAC(masterkey.Bytes()); err != ErrConfigTampered {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+	// Creator is informational only
+	c := *cf
+	c.Creator = "someone else"
+	if err := c.VerifyMAC(masterkey.Bytes()); err != nil {
+		t.Errorf("Creator: got %v", err)
+	}
+}
+
+// legacyConfig turns "cf" into a config like gocryptfs writes them: no
+// FlagConfigMAC, no MAC and a master key encrypted without binding. The new
+// scrypt hash is copied to "returnedScryptHashBuff".
+func legacyConfig(t *testing.T, cf *ConfFile, password string, returnedScryptHashBuff []byte) {
+	t.Helper()
+	masterkey, err := cf.GetMasterkey([]byte(password), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer masterkey.Destroy()
+	var flags []string
+	for _, f := range cf.FeatureFlags {
+		if f != knownFlags[FlagConfigMAC] {
+			flags = append(flags, f)
+		}
+	}
+	cf.FeatureFlags = flags
+	cf.ConfigMAC = nil
+	scryptHash := cf.EncryptKey(masterkey.Bytes(), []byte(password), scryptMinLogN, true)
+	cf.CopyScryptHash(returnedScryptHashBuff, scryptHash.Bytes())
+	scryptHash.Destroy()
+}
+
+// New configs require their MAC.
+func TestConfigMACNew(t *testing.T) {
+	cf := createTestConfig(t, "test", nil)
+	if !cf.IsFeatureFlagSet(FlagConfigMAC) {
+		t.Fatal("new config does not require its MAC")
+	}
+	cf.ConfigMAC = nil
+	if _, err := cf.GetMasterkey([]byte("test"), nil, nil); err != ErrConfigTampered {
+		t.Errorf("missing MAC: got %v", err)
+	}
+}
+
+func TestConfigMACRequired(t *testing.T) {
+	envelope := make([]byte, ScryptHashEnvelopeLen)
+	cf := createTestConfig(t, "test", nil)
+	legacyConfig(t, cf, "test", envelope)
+
+	// Configs without MAC are accepted until they are migrated
+	masterkey, err := cf.GetMasterkey([]byte("test"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey.Destroy()
+
+	if err = cf.RequireMAC([]byte("wrong"), nil); err == nil {
+		t.Fatal("RequireMAC accepted a wrong password")
+	}
+	if err = cf.RequireMAC(nil, envelope); err != nil {
+		t.Fatal(err)
+	}
+	if !cf.HasMAC() || !cf.IsFeatureFlagSet(FlagConfigMAC) {
+		t.Fatal("not migrated")
+	}
+	// The scrypt hash stays valid
+	masterkey, err = cf.GetMasterkey(nil, envelope, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey.Destroy()
+
+	stripped := *cf
+	stripped.ConfigMAC = nil
+	if _, err = stripped.GetMasterkey([]byte("test"), nil, nil); err != ErrConfigTampered {
+		t.Errorf("missing MAC: got %v", err)
+	}
+	// Removing the flag as well breaks the master key
+	stripped.FeatureFlags = nil
+	for _, f := range cf.FeatureFlags {
+		if f != knownFlags[FlagConfigMAC] {
+			stripped.FeatureFlags = append(stripped.FeatureFlags, f)
+		}
+	}
+	if _, err = stripped.GetMasterkey([]byte("test"), nil, nil); err == nil {
+		t.Error("master key decrypted without FlagConfigMAC")
+	}
+}
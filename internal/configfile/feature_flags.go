@@ -34,6 +34,12 @@ const (
 	FlagFIDO2
 	// FlagXChaCha20Poly1305 means we use XChaCha20-Poly1305 file content encryption
 	FlagXChaCha20Poly1305
+	// FlagConfigMAC (libgocryptfs only) means that the config file must carry
+	// a valid ConfigMAC. The master key is encrypted bound to this flag, so
+	// it can't be removed to make the MAC optional again. Set on new configs
+	// and by RequireMAC. gocryptfs does not know this flag and refuses to
+	// mount such volumes.
+	FlagConfigMAC
 )
 
 // knownFlags stores the known feature flags and their string representation
@@ -49,6 +55,7 @@ var knownFlags = map[flagIota]string{
 	FlagHKDF:              "HKDF",
 	FlagFIDO2:             "FIDO2",
 	FlagXChaCha20Poly1305: "XChaCha20Poly1305",
+	FlagConfigMAC:         "ConfigMAC",
 }
 
 // isFeatureFlagKnown verifies that we understand a feature flag.
@@ -61,6 +68,16 @@ func isFeatureFlagKnown(flag string) bool {
 	return false
 }
 
+// KnownFeatureFlags returns the names of the feature flags this version
+// understands, sorted by flag value.
+func KnownFeatureFlags() []string {
+	names := make([]string, 0, len(knownFlags))
+	for flag := FlagPlaintextNames; flag <= FlagConfigMAC; flag++ {
+		names = append(names, knownFlags[flag])
+	}
+	return names
+}
+
 // IsFeatureFlagSet returns true if the feature flag "flagWant" is enabled.
 func (cf *ConfFile) IsFeatureFlagSet(flagWant flagIota) bool {
 	flagString := knownFlags[flagWant]
@@ -0,0 +1,73 @@
+package configfile
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// Scrypt hashes are handed to the host so that it can unlock the volume
+// without the password later (fingerprint unlock). Wrapped in an envelope,
+// they are bound to the scrypt salt and parameters they were derived with, so
+// that a hash made stale by a password change can be told apart from a wrong
+// one:
+//
+//	version (1 byte) | binding (16 bytes) | scrypt hash (32 bytes)
+//
+// Only buffers of exactly ScryptHashEnvelopeLen bytes hold an envelope, both
+// when returning and when accepting a hash. Buffers of any other length get
+// the raw hash, like before.
+const (
+	scryptHashEnvelopeVersion = 1
+	scryptHashBindingLen      = 16
+	// ScryptHashEnvelopeLen is the length of an enveloped scrypt hash
+	ScryptHashEnvelopeLen = 1 + scryptHashBindingLen + 32
+)
+
+// ErrStaleScryptHash is returned when an enveloped scrypt hash was derived
+// with other scrypt parameters than the current ones, usually because the
+// password has been changed since. Raw hashes have no binding: they get it
+// whenever they don't decrypt the masterkey.
+var ErrStaleScryptHash = errors.New("scrypt hash does not match the current password")
+
+// binding identifies the salt and the parameters of "s".
+func (s *ScryptKDF) binding() []byte {
+	h := sha256.New()
+	h.Write([]byte("libgocryptfs scrypt hash binding"))
+	var params [32]byte
+	binary.BigEndian.PutUint64(params[0:], uint64(s.N))
+	binary.BigEndian.PutUint64(params[8:], uint64(s.R))
+	binary.BigEndian.PutUint64(params[16:], uint64(s.P))
+	binary.BigEndian.PutUint64(params[24:], uint64(s.KeyLen))
+	h.Write(params[:])
+	h.Write(s.Salt)
+	return h.Sum(nil)[:scryptHashBindingLen]
+}
+
+// CopyScryptHash copies "scryptHash" to "dst", in an envelope if "dst" is
+// ScryptHashEnvelopeLen bytes long.
+func (cf *ConfFile) CopyScryptHash(dst, scryptHash []byte) {
+	if len(dst) != ScryptHashEnvelopeLen {
+		copy(dst, scryptHash)
+		return
+	}
+	dst[0] = scryptHashEnvelopeVersion
+	copy(dst[1:], cf.ScryptObject.binding())
+	copy(dst[1+scryptHashBindingLen:], scryptHash)
+}
+
+// openScryptHash returns the raw scrypt hash in "given". Enveloped hashes are
+// checked against the current scrypt parameters, raw ones are returned as-is.
+func (cf *ConfFile) openScryptHash(given []byte) ([]byte, error) {
+	if len(given) != ScryptHashEnvelopeLen {
+		return given, nil
+	}
+	if given[0] != scryptHashEnvelopeVersion {
+		return nil, errors.New("unsupported scrypt hash envelope version")
+	}
+	if subtle.ConstantTimeCompare(given[1:1+scryptHashBindingLen], cf.ScryptObject.binding()) != 1 {
+		return nil, ErrStaleScryptHash
+	}
+	return given[1+scryptHashBindingLen:], nil
+}
@@ -0,0 +1,87 @@
+package configfile
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// createTestConfig creates a config file protected by "password" with the
+// lowest scrypt cost and loads it.
+func createTestConfig(t *testing.T, password string, returnedScryptHashBuff []byte) *ConfFile {
+	filename := filepath.Join(t.TempDir(), ConfDefaultName)
+	err := Create(&CreateArgs{
+		Filename: filename,
+		Password: []byte(password),
+		LogN:     scryptMinLogN,
+		Creator:  "test",
+	}, returnedScryptHashBuff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cf
+}
+
+func TestScryptHashEnvelope(t *testing.T) {
+	envelope := make([]byte, ScryptHashEnvelopeLen)
+	cf := createTestConfig(t, "test", envelope)
+	if envelope[0] != scryptHashEnvelopeVersion {
+		t.Fatalf("no envelope: %x", envelope)
+	}
+	masterkey, err := cf.GetMasterkey(nil, envelope, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey.Destroy()
+
+	raw := make([]byte, 32)
+	masterkey, err = cf.GetMasterkey([]byte("test"), nil, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey.Destroy()
+	if !bytes.Equal(raw, envelope[1+scryptHashBindingLen:]) {
+		t.Error("raw hash does not match the enveloped one")
+	}
+	masterkey, err = cf.GetMasterkey(nil, raw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey.Destroy()
+
+	// Buffers longer than an envelope get the raw hash
+	long := make([]byte, ScryptHashEnvelopeLen+1)
+	cf.CopyScryptHash(long, raw)
+	if !bytes.Equal(long[:32], raw) {
+		t.Errorf("long buffer got %x", long)
+	}
+}
+
+func TestScryptHashEnvelopeStale(t *testing.T) {
+	envelope := make([]byte, ScryptHashEnvelopeLen)
+	raw := make([]byte, 32)
+	cf := createTestConfig(t, "old", envelope)
+	masterkey, err := cf.GetMasterkey([]byte("old"), nil, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.EncryptKey(masterkey.Bytes(), []byte("new"), scryptMinLogN, false)
+	masterkey.Destroy()
+
+	if _, err = cf.GetMasterkey(nil, envelope, nil); err != ErrStaleScryptHash {
+		t.Errorf("stale envelope: got %v", err)
+	}
+	// Raw hashes carry no binding, they are stale once they don't decrypt
+	// anymore
+	if _, err = cf.GetMasterkey(nil, raw, nil); err != ErrStaleScryptHash {
+		t.Errorf("stale raw hash: got %v", err)
+	}
+	envelope[0] = scryptHashEnvelopeVersion + 1
+	if _, err = cf.GetMasterkey(nil, envelope, nil); err == nil {
+		t.Error("unknown envelope version accepted")
+	}
+}
@@ -0,0 +1,169 @@
+package configfile
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log"
+
+	"golang.org/x/crypto/hkdf"
+
+	"libgocryptfs/v2/internal/cryptocore"
+	"libgocryptfs/v2/internal/securemem"
+)
+
+// RecoveryRecipient is an additional copy of the master key, encrypted to
+// the X25519 public key of a recovery key (key escrow). The master key is
+// encrypted with a key derived from the Diffie-Hellman secret of an
+// ephemeral key pair and the recipient key.
+type RecoveryRecipient struct {
+	// Label is a name chosen by the user, like "ACME IT department"
+	Label string
+	// PublicKey is the X25519 public key of the recipient
+	PublicKey []byte
+	// EphemeralKey is the X25519 public key of the ephemeral key pair
+	EphemeralKey []byte
+	// EncryptedKey is the encrypted master key
+	EncryptedKey []byte
+}
+
+const hkdfInfoRecovery = "libgocryptfs recovery key wrapping"
+
+var (
+	// ErrRecipientExists is returned by AddRecoveryRecipient if the public
+	// key is already a recipient.
+	ErrRecipientExists = errors.New("recovery recipient already exists")
+	// ErrNoRecipient is returned when no recovery recipient matches a key.
+	ErrNoRecipient = errors.New("no matching recovery recipient")
+)
+
+// GenerateRecoveryKey returns a new X25519 key pair. The private key is in
+// locked memory, the caller must Destroy() it.
+func GenerateRecoveryKey() (private *securemem.Buffer, public []byte, err error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	private = securemem.Move(priv.Bytes())
+	return private, priv.PublicKey().Bytes(), nil
+}
+
+// recoveryWrapKey derives the key encrypting the master key from the
+// Diffie-Hellman "secret" and both public keys.
+func recoveryWrapKey(secret, ephemeralKey, publicKey []byte) *securemem.Buffer {
+	salt := append(append([]byte(nil), ephemeralKey...), publicKey...)
+	wrapKey := securemem.New(cryptocore.KeyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(hkdfInfoRecovery)), wrapKey.Bytes()); err != nil {
+		log.Panicf("recoveryWrapKey: %v", err)
+	}
+	return wrapKey
+}
+
+// AddRecoveryRecipient encrypts "masterkey" to the X25519 "publicKey" and
+// adds it to the recovery recipients. Call SetMAC and WriteFile afterwards.
+func (cf *ConfFile) AddRecoveryRecipient(masterkey []byte, publicKey []byte, label string) error {
+	recipientKey, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if cf.findRecipient(publicKey) >= 0 {
+		return ErrRecipientExists
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	secret, err := ephemeral.ECDH(recipientKey)
+	if err != nil {
+		return err
+	}
+	ephemeralKey := ephemeral.PublicKey().Bytes()
+	wrapKey := recoveryWrapKey(secret, ephemeralKey, publicKey)
+	for i := range secret {
+		secret[i] = 0
+	}
+	ce := getKeyEncrypter(wrapKey.Bytes(), true)
+	wrapKey.Destroy()
+	encryptedKey := ce.EncryptBlock(masterkey, 0, nil)
+	ce.Wipe()
+	cf.RecoveryRecipients = append(cf.RecoveryRecipients, RecoveryRecipient{
+		Label:        label,
+		PublicKey:    append([]byte(nil), publicKey...),
+		EphemeralKey: ephemeralKey,
+		EncryptedKey: encryptedKey,
+	})
+	return nil
+}
+
+// RemoveRecoveryRecipient removes the recipient with "publicKey". Call
+// SetMAC and WriteFile afterwards.
+func (cf *ConfFile) RemoveRecoveryRecipient(publicKey []byte) error {
+	i := cf.findRecipient(publicKey)
+	if i < 0 {
+		return ErrNoRecipient
+	}
+	cf.RecoveryRecipients = append(cf.RecoveryRecipients[:i], cf.RecoveryRecipients[i+1:]...)
+	if len(cf.RecoveryRecipients) == 0 {
+		// Keep the config (and its MAC) identical to one that never had
+		// recipients
+		cf.RecoveryRecipients = nil
+	}
+	return nil
+}
+
+// DecryptMasterKeyWithRecoveryKey decrypts the master key with the X25519
+// "privateKey" of a recovery recipient and verifies the config MAC.
+// The master key is returned in locked memory, the caller must Destroy() it.
+//
+// Configs without MAC are rejected with ErrConfigTampered: recipients can be
+// added by anyone, only the MAC tells if the master key is the right one.
+func (cf *ConfFile) DecryptMasterKeyWithRecoveryKey(privateKey []byte) (*securemem.Buffer, error) {
+	if !cf.HasMAC() {
+		return nil, ErrConfigTampered
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	i := cf.findRecipient(priv.PublicKey().Bytes())
+	if i < 0 {
+		return nil, ErrNoRecipient
+	}
+	r := &cf.RecoveryRecipients[i]
+	ephemeralKey, err := ecdh.X25519().NewPublicKey(r.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := priv.ECDH(ephemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey := recoveryWrapKey(secret, r.EphemeralKey, r.PublicKey)
+	for i := range secret {
+		secret[i] = 0
+	}
+	ce := getKeyEncrypter(wrapKey.Bytes(), true)
+	wrapKey.Destroy()
+	key, err := ce.DecryptBlock(r.EncryptedKey, 0, nil)
+	ce.Wipe()
+	if err != nil {
+		return nil, ErrNoRecipient
+	}
+	masterkey := securemem.Move(key)
+	if err = cf.verifyMasterkey(masterkey); err != nil {
+		return nil, err
+	}
+	return masterkey, nil
+}
+
+func (cf *ConfFile) findRecipient(publicKey []byte) int {
+	for i := range cf.RecoveryRecipients {
+		if bytes.Equal(cf.RecoveryRecipients[i].PublicKey, publicKey) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,77 @@
+package configfile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRecoveryKey(t *testing.T) {
+	cf := createTestConfig(t, "test", nil)
+	masterkey, err := cf.GetMasterkey([]byte("test"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer masterkey.Destroy()
+	private, public, err := GenerateRecoveryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer private.Destroy()
+	if err = cf.AddRecoveryRecipient(masterkey.Bytes(), public, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.AddRecoveryRecipient(masterkey.Bytes(), public, "test"); err != ErrRecipientExists {
+		t.Errorf("duplicate recipient: got %v", err)
+	}
+	cf.SetMAC(masterkey.Bytes())
+
+	recovered, err := cf.DecryptMasterKeyWithRecoveryKey(private.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recovered.Bytes(), masterkey.Bytes()) {
+		t.Error("recovered a different master key")
+	}
+	recovered.Destroy()
+
+	other, _, err := GenerateRecoveryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Destroy()
+	if _, err = cf.DecryptMasterKeyWithRecoveryKey(other.Bytes()); err != ErrNoRecipient {
+		t.Errorf("other key: got %v", err)
+	}
+
+	if err = cf.RemoveRecoveryRecipient(public); err != nil {
+		t.Fatal(err)
+	}
+	if cf.RecoveryRecipients != nil {
+		t.Error("recipients not reset")
+	}
+	if _, err = cf.DecryptMasterKeyWithRecoveryKey(private.Bytes()); err != ErrNoRecipient {
+		t.Errorf("removed key: got %v", err)
+	}
+}
+
+// A recipient added by someone without the master key must not unlock, even
+// after stripping the MAC.
+func TestRecoveryKeyForged(t *testing.T) {
+	cf := createTestConfig(t, "test", nil)
+	private, public, err := GenerateRecoveryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer private.Destroy()
+	forgedKey := bytes.Repeat([]byte{0x42}, 32)
+	if err = cf.AddRecoveryRecipient(forgedKey, public, "forged"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.DecryptMasterKeyWithRecoveryKey(private.Bytes()); err != ErrConfigTampered {
+		t.Errorf("forged recipient: got %v", err)
+	}
+	cf.ConfigMAC = nil
+	if _, err = cf.DecryptMasterKeyWithRecoveryKey(private.Bytes()); err != ErrConfigTampered {
+		t.Errorf("forged recipient without MAC: got %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package configfile
+
+import (
+	"libgocryptfs/v2/internal/securemem"
+)
+
+// Rekeyed returns a copy of the config for a new random master key, which is
+// returned in locked memory and must be Destroy()ed by the caller.
+//
+// The new master key is encrypted with "password" under a new scrypt salt
+// with cost "logN", and to the recovery recipients of the config. The new
+// config gets a MAC if the old one had one. The scrypt
+// hash is copied to "returnedScryptHashBuff" if it is not empty, like
+// GetMasterkey does. WriteFile writes the new config to "filename".
+func (cf *ConfFile) Rekeyed(filename string, password []byte, logN int, returnedScryptHashBuff []byte) (*ConfFile, *securemem.Buffer, error) {
+	newCf := *cf
+	newCf.filename = filename
+	newCf.FeatureFlags = append([]string(nil), cf.FeatureFlags...)
+	newCf.ConfigMAC = nil
+	newCf.RecoveryRecipients = nil
+	key, err := newMasterkey()
+	if err != nil {
+		return nil, nil, err
+	}
+	scryptHash := newCf.EncryptKey(key.Bytes(), password, logN, len(returnedScryptHashBuff) > 0)
+	if scryptHash != nil {
+		newCf.CopyScryptHash(returnedScryptHashBuff, scryptHash.Bytes())
+		scryptHash.Destroy()
+	}
+	for _, r := range cf.RecoveryRecipients {
+		if err = newCf.AddRecoveryRecipient(key.Bytes(), r.PublicKey, r.Label); err != nil {
+			key.Destroy()
+			return nil, nil, err
+		}
+	}
+	if cf.HasMAC() {
+		newCf.SetMAC(key.Bytes())
+	}
+	return &newCf, key, nil
+}
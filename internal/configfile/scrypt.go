@@ -10,6 +10,7 @@ import (
 
 	"libgocryptfs/v2/internal/cryptocore"
 	"libgocryptfs/v2/internal/exitcodes"
+	"libgocryptfs/v2/internal/securemem"
 )
 
 const (
@@ -61,7 +62,8 @@ func NewScryptKDF(logN int) ScryptKDF {
 }
 
 // DeriveKey returns a new key from a supplied password.
-func (s *ScryptKDF) DeriveKey(pw []byte) []byte {
+// The key is moved out of the Go heap, the caller must Destroy() it.
+func (s *ScryptKDF) DeriveKey(pw []byte) *securemem.Buffer {
 	if err := s.validateParams(); err != nil {
 		os.Exit(exitcodes.ScryptParams)
 	}
@@ -69,7 +71,7 @@ func (s *ScryptKDF) DeriveKey(pw []byte) []byte {
 	if err != nil {
 		log.Panicf("DeriveKey failed: %v", err)
 	}
-	return k
+	return securemem.Move(k)
 }
 
 // LogN - N is saved as 2^LogN, but LogN is much easier to work with.
@@ -13,6 +13,7 @@ import (
 
 	"github.com/rfjakob/eme"
 
+	"libgocryptfs/v2/internal/securemem"
 	"libgocryptfs/v2/internal/siv_aead"
 	"libgocryptfs/v2/internal/stupidgcm"
 )
@@ -80,6 +81,10 @@ type CryptoCore struct {
 //
 // Note: "key" is either the scrypt hash of the password (when decrypting
 // a config file) or the masterkey (when finally mounting the filesystem).
+//
+// The keys derived from "key" are kept in securemem buffers only until the
+// ciphers are set up. The ciphers store their own key schedules on the Go
+// heap, see the securemem package documentation.
 func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoCore {
 	if len(key) != KeyLen {
 		log.Panicf("Unsupported key length of %d bytes", len(key))
@@ -95,10 +100,8 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 		var emeBlockCipher cipher.Block
 		if useHKDF {
 			emeKey := hkdfDerive(key, hkdfInfoEMENames, KeyLen)
-			emeBlockCipher, err = aes.NewCipher(emeKey)
-			for i := range emeKey {
-				emeKey[i] = 0
-			}
+			emeBlockCipher, err = aes.NewCipher(emeKey.Bytes())
+			emeKey.Destroy()
 		} else {
 			emeBlockCipher, err = aes.NewCipher(key)
 		}
@@ -111,22 +114,22 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 	// Initialize an AEAD cipher for file content encryption.
 	var aeadCipher cipher.AEAD
 	if aeadType == BackendOpenSSL || aeadType == BackendGoGCM {
-		var gcmKey []byte
+		var gcmKey *securemem.Buffer
 		if useHKDF {
 			gcmKey = hkdfDerive(key, hkdfInfoGCMContent, KeyLen)
 		} else {
 			// Filesystems created by gocryptfs v0.7 through v1.2 don't use HKDF.
 			// Example: tests/example_filesystems/v0.9
-			gcmKey = append([]byte{}, key...)
+			gcmKey = securemem.Copy(key)
 		}
 		switch aeadType {
 		case BackendOpenSSL:
 			if IVBitLen != 128 {
 				log.Panicf("stupidgcm only supports 128-bit IVs, you wanted %d", IVBitLen)
 			}
-			aeadCipher = stupidgcm.NewAES256GCM(gcmKey)
+			aeadCipher = stupidgcm.NewAES256GCM(gcmKey.Bytes())
 		case BackendGoGCM:
-			goGcmBlockCipher, err := aes.NewCipher(gcmKey)
+			goGcmBlockCipher, err := aes.NewCipher(gcmKey.Bytes())
 			if err != nil {
 				log.Panic(err)
 			}
@@ -137,9 +140,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 		default:
 			log.Panicf("BUG: unhandled case: %v", aeadType)
 		}
-		for i := range gcmKey {
-			gcmKey[i] = 0
-		}
+		gcmKey.Destroy()
 	} else if aeadType == BackendAESSIV {
 		if IVBitLen != 128 {
 			// SIV supports any nonce size, but we only use 128.
@@ -149,17 +150,18 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 		// encryption, so we need a 64-bytes key for AES-256. Derive it from
 		// the 32-byte master key using HKDF, or, for older filesystems, with
 		// SHA256.
-		var key64 []byte
+		var key64 *securemem.Buffer
 		if useHKDF {
 			key64 = hkdfDerive(key, hkdfInfoSIVContent, siv_aead.KeyLen)
 		} else {
 			s := sha512.Sum512(key)
-			key64 = s[:]
-		}
-		aeadCipher = siv_aead.New(key64)
-		for i := range key64 {
-			key64[i] = 0
+			key64 = securemem.Copy(s[:])
+			for i := range s {
+				s[i] = 0
+			}
 		}
+		aeadCipher = siv_aead.New(key64.Bytes())
+		key64.Destroy()
 	} else if aeadType == BackendXChaCha20Poly1305 || aeadType == BackendXChaCha20Poly1305OpenSSL {
 		// We don't support legacy modes with XChaCha20-Poly1305
 		if IVBitLen != chacha20poly1305.NonceSizeX*8 {
@@ -170,12 +172,13 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 		}
 		derivedKey := hkdfDerive(key, hkdfInfoXChaChaPoly1305Content, chacha20poly1305.KeySize)
 		if aeadType == BackendXChaCha20Poly1305 {
-			aeadCipher, err = chacha20poly1305.NewX(derivedKey)
+			aeadCipher, err = chacha20poly1305.NewX(derivedKey.Bytes())
 		} else if aeadType == BackendXChaCha20Poly1305OpenSSL {
-			aeadCipher = stupidgcm.NewXchacha20poly1305(derivedKey)
+			aeadCipher = stupidgcm.NewXchacha20poly1305(derivedKey.Bytes())
 		} else {
 			log.Panicf("BUG: unhandled case: %v", aeadType)
 		}
+		derivedKey.Destroy()
 		if err != nil {
 			log.Panic(err)
 		}
@@ -5,6 +5,8 @@ import (
 	"log"
 
 	"golang.org/x/crypto/hkdf"
+
+	"libgocryptfs/v2/internal/securemem"
 )
 
 const (
@@ -14,17 +16,25 @@ const (
 	hkdfInfoGCMContent             = "AES-GCM file content encryption"
 	hkdfInfoSIVContent             = "AES-SIV file content encryption"
 	hkdfInfoXChaChaPoly1305Content = "XChaCha20-Poly1305 file content encryption"
+	hkdfInfoConfigMAC              = "gocryptfs.conf authentication"
 )
 
 // hkdfDerive derives "outLen" bytes from "masterkey" and "info" using
 // HKDF-SHA256 (RFC 5869).
-// It returns the derived bytes or panics.
-func hkdfDerive(masterkey []byte, info string, outLen int) (out []byte) {
+// It returns the derived bytes in a securemem.Buffer the caller must
+// Destroy(), or panics.
+func hkdfDerive(masterkey []byte, info string, outLen int) (out *securemem.Buffer) {
 	h := hkdf.New(sha256.New, masterkey, nil, []byte(info))
-	out = make([]byte, outLen)
-	n, err := h.Read(out)
+	out = securemem.New(outLen)
+	n, err := h.Read(out.Bytes())
 	if n != outLen || err != nil {
 		log.Panicf("hkdfDerive: hkdf read failed, got %d bytes, error: %v", n, err)
 	}
 	return out
 }
+
+// ConfigMACKey derives the key authenticating the config file from
+// "masterkey". The caller must Destroy() it.
+func ConfigMACKey(masterkey []byte) *securemem.Buffer {
+	return hkdfDerive(masterkey, hkdfInfoConfigMAC, KeyLen)
+}
@@ -0,0 +1,290 @@
+// Package ctlsocksrv implements the gocryptfs control socket protocol, so
+// that tools written for gocryptfs "-ctlsock" (gocryptfs-xray, scripts...)
+// work against volumes opened by libgocryptfs.
+//
+// Requests and responses are JSON objects. EncryptPath and DecryptPath are
+// compatible with gocryptfs. ListDir and Stat are libgocryptfs extensions.
+package ctlsocksrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// RequestStruct is sent by a client (encoded as JSON).
+// Exactly one of the fields must be set.
+type RequestStruct struct {
+	// EncryptPath is the path that should be encrypted.
+	EncryptPath string
+	// DecryptPath is the path that should be decrypted.
+	DecryptPath string
+	// ListDir is the plaintext path of a directory that should be listed.
+	// Use "/" for the root directory.
+	ListDir string `json:",omitempty"`
+	// Stat is the plaintext path of a file or directory whose attributes
+	// should be returned.
+	Stat string `json:",omitempty"`
+}
+
+// DirEntry is a directory entry returned in response to ListDir.
+type DirEntry struct {
+	Name string
+	Mode uint32
+}
+
+// StatStruct holds the attributes returned in response to Stat.
+type StatStruct struct {
+	Mode  uint32
+	Size  uint64
+	Mtime uint64
+}
+
+// ResponseStruct is sent by the server in response to a request
+// (encoded as JSON).
+type ResponseStruct struct {
+	// Result is the resulting decrypted or encrypted path. Empty on error.
+	Result string
+	// ErrNo is the error number as defined in errno.h.
+	// 0 means success and -1 means that the error number is not known
+	// (look at ErrText in this case).
+	ErrNo int32
+	// ErrText is a detailed error message.
+	ErrText string
+	// WarnText contains warnings that may have been encountered while
+	// processing the message.
+	WarnText string
+	// Entries is the result of ListDir.
+	Entries []DirEntry `json:",omitempty"`
+	// Stat is the result of Stat.
+	Stat *StatStruct `json:",omitempty"`
+}
+
+// Interface is implemented by the volume the socket is serving.
+type Interface interface {
+	EncryptPath(string) (string, error)
+	DecryptPath(string) (string, error)
+	ListDir(string) ([]DirEntry, error)
+	Stat(string) (*StatStruct, error)
+}
+
+// Server accepts connections on a unix socket and answers requests.
+type Server struct {
+	fs     Interface
+	socket *Listener
+	// Open connections, closed by Close()
+	connsLock sync.Mutex
+	conns     map[*net.UnixConn]struct{}
+	closed    bool
+}
+
+// Listener is a unix socket created by Listen.
+type Listener struct {
+	*net.UnixListener
+	path string
+}
+
+// Listen creates the socket at "path", accessible only by the current user.
+// A stale socket left behind by a crashed process is replaced.
+//
+// Sockets are created with the permissions allowed by the umask, so the socket
+// is bound in a new private directory, restricted, then moved to "path".
+// Otherwise other users could connect before the permissions are fixed.
+func Listen(path string) (*Listener, error) {
+	if st, err := os.Lstat(path); err == nil {
+		if st.Mode()&os.ModeSocket == 0 {
+			return nil, syscall.EEXIST
+		}
+		// Is someone listening?
+		conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+		if err == nil {
+			conn.Close()
+			return nil, syscall.EADDRINUSE
+		}
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".ctlsock.")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+	tmpPath := filepath.Join(dir, "sock")
+	sock, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is deleted by Listener.Close
+	sock.SetUnlinkOnClose(false)
+	err = os.Chmod(tmpPath, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		sock.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return &Listener{UnixListener: sock, path: path}, nil
+}
+
+// Close closes the socket and deletes the socket file.
+func (l *Listener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// Serve serves incoming connections on "sock" in a new goroutine.
+func Serve(sock *Listener, fs Interface) *Server {
+	srv := &Server{
+		fs:     fs,
+		socket: sock,
+		conns:  make(map[*net.UnixConn]struct{}),
+	}
+	go srv.acceptLoop()
+	return srv
+}
+
+// Close stops accepting connections, closes the open ones and deletes the
+// socket file.
+func (srv *Server) Close() error {
+	srv.connsLock.Lock()
+	srv.closed = true
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.connsLock.Unlock()
+	return srv.socket.Close()
+}
+
+func (srv *Server) acceptLoop() {
+	for {
+		conn, err := srv.socket.AcceptUnix()
+		if err != nil {
+			// This triggers on Close() with "use of closed network connection".
+			break
+		}
+		srv.connsLock.Lock()
+		if srv.closed {
+			srv.connsLock.Unlock()
+			conn.Close()
+			break
+		}
+		srv.conns[conn] = struct{}{}
+		srv.connsLock.Unlock()
+		go srv.handleConnection(conn)
+	}
+}
+
+// ReadBufSize is the size of the request read buffer.
+// The longest possible path is 4096 bytes on Linux so 5000 bytes should be
+// enough to hold the whole JSON request. This assumes that the path does not
+// contain too many characters that had to be escaped in JSON (for example, a
+// null byte blows up to "\u0000").
+// We abort the connection if the request is bigger than this.
+const ReadBufSize = 5000
+
+// handleConnection reads and parses JSON requests from "conn"
+func (srv *Server) handleConnection(conn *net.UnixConn) {
+	defer func() {
+		srv.connsLock.Lock()
+		delete(srv.conns, conn)
+		srv.connsLock.Unlock()
+		conn.Close()
+	}()
+	buf := make([]byte, ReadBufSize)
+	for {
+		n, err := conn.Read(buf)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			return
+		}
+		if n == ReadBufSize {
+			// Request too big
+			return
+		}
+		data := buf[:n]
+		var in RequestStruct
+		err = json.Unmarshal(data, &in)
+		if err != nil {
+			err = errors.New("JSON Unmarshal error: " + err.Error())
+			sendResponse(conn, &ResponseStruct{}, err)
+			continue
+		}
+		srv.handleRequest(&in, conn)
+	}
+}
+
+// handleRequest handles an already-unmarshaled JSON request
+func (srv *Server) handleRequest(in *RequestStruct, conn *net.UnixConn) {
+	var inPath string
+	n := 0
+	for _, p := range []string{in.EncryptPath, in.DecryptPath, in.ListDir, in.Stat} {
+		if p != "" {
+			inPath = p
+			n++
+		}
+	}
+	// You cannot perform several operations in one request
+	if n > 1 {
+		sendResponse(conn, &ResponseStruct{}, errors.New("Ambiguous"))
+		return
+	}
+	// No operation has been requested, makes no sense
+	if n == 0 {
+		sendResponse(conn, &ResponseStruct{}, errors.New("empty input"))
+		return
+	}
+	// Canonicalize input path
+	out := &ResponseStruct{}
+	clean := SanitizePath(inPath)
+	// Warn if a non-canonical path was passed
+	if inPath != clean {
+		out.WarnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", inPath, clean)
+	}
+	var err error
+	switch {
+	case in.ListDir != "":
+		// The root directory can be listed
+		out.Entries, err = srv.fs.ListDir(clean)
+	case clean == "":
+		// Error out if the canonical path is now empty
+		err = errors.New("empty input after canonicalization")
+	case in.EncryptPath != "":
+		out.Result, err = srv.fs.EncryptPath(clean)
+	case in.DecryptPath != "":
+		out.Result, err = srv.fs.DecryptPath(clean)
+	case in.Stat != "":
+		out.Stat, err = srv.fs.Stat(clean)
+	}
+	sendResponse(conn, out, err)
+}
+
+// sendResponse sends a JSON response message
+func sendResponse(conn *net.UnixConn, msg *ResponseStruct, err error) {
+	if err != nil {
+		msg.Result = ""
+		msg.Entries = nil
+		msg.Stat = nil
+		msg.ErrText = err.Error()
+		msg.ErrNo = -1
+		// Try to extract the actual error number
+		var se syscall.Errno
+		if errors.As(err, &se) {
+			msg.ErrNo = int32(se)
+		}
+	}
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	// For convenience for the user, add a newline at the end.
+	jsonMsg = append(jsonMsg, '\n')
+	conn.Write(jsonMsg)
+}
@@ -0,0 +1,92 @@
+package ctlsocksrv
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+type testFS struct{}
+
+func (testFS) EncryptPath(p string) (string, error) { return "enc/" + p, nil }
+func (testFS) DecryptPath(p string) (string, error) { return "", syscall.ENOENT }
+func (testFS) ListDir(string) ([]DirEntry, error)   { return nil, nil }
+func (testFS) Stat(string) (*StatStruct, error)     { return nil, nil }
+
+func request(t *testing.T, path string, req string) *ResponseStruct {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(req))
+	buf := make([]byte, ReadBufSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ResponseStruct
+	if err = json.Unmarshal(buf[:n], &resp); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ctl.sock")
+	sock, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&os.ModeSocket == 0 || st.Mode().Perm() != 0600 {
+		t.Errorf("mode %v", st.Mode())
+	}
+	// The private directory is gone
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("left behind: %v", entries)
+	}
+	srv := Serve(sock, testFS{})
+	if resp := request(t, path, `{"EncryptPath":"a/../b"}`); resp.Result != "enc/b" || resp.WarnText == "" {
+		t.Errorf("EncryptPath: %+v", resp)
+	}
+	if resp := request(t, path, `{"DecryptPath":"x"}`); resp.ErrNo != int32(syscall.ENOENT) {
+		t.Errorf("DecryptPath: %+v", resp)
+	}
+	// Someone is listening
+	if _, err = Listen(path); err == nil {
+		t.Error("replaced a live socket")
+	}
+	srv.Close()
+	if _, err = os.Lstat(path); !os.IsNotExist(err) {
+		t.Error("socket file not deleted")
+	}
+}
+
+func TestListenStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	sock, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave the socket file behind, like a crashed process
+	sock.UnixListener.Close()
+	sock, err = Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock.Close()
+
+	os.WriteFile(path, nil, 0600)
+	if _, err = Listen(path); err == nil {
+		t.Error("replaced a regular file")
+	}
+}
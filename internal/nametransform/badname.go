@@ -48,8 +48,8 @@ func (be *NameTransform) EncryptAndHashBadName(name string, iv []byte, dirfd int
 			//expand suffix on error
 			continue
 		}
-		if len(cName) > be.longNameMax {
-			cNamePart = be.HashLongName(cName)
+		if len(cNamePart) > be.longNameMax {
+			cNamePart = be.HashLongName(cNamePart)
 		}
 		cNameBadReverse := cNamePart + name[charpos:len(name)-len(BadnameSuffix)]
 		err = syscallcompat.Fstatat(dirfd, cNameBadReverse, &st, unix.AT_SYMLINK_NOFOLLOW)
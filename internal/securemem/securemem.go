@@ -0,0 +1,130 @@
+// Package securemem allocates memory for secret keys outside of the Go heap.
+//
+// Key material in ordinary byte slices can be copied around by the garbage
+// collector, and wiping the slice does not reach the copies. A Buffer is
+// backed by an anonymous mapping that the GC never touches. The mapping is
+// mlock()ed so it is never written to swap, excluded from core dumps, and
+// surrounded by inaccessible guard pages so that overflows crash instead of
+// leaking into adjacent memory.
+//
+// Only the raw key bytes are protected. Cipher instances built from them, like
+// the AES key schedule of aes.NewCipher or the state kept by
+// chacha20poly1305.NewX, are allocated by their packages on the Go heap, which
+// is neither locked nor excluded from core dumps, and can't be wiped reliably.
+// mlock() may also fail (see Buffer.Locked), in which case the pages can still
+// be swapped out. If the mapping itself can't be created, New falls back to
+// memory on the Go heap and logs a warning rather than failing: losing the
+// protection is better than making the volume impossible to open.
+package securemem
+
+import (
+	"log"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmap is unix.Mmap, replaced by tests to simulate failures.
+var mmap = unix.Mmap
+
+// Buffer is a fixed-size chunk of memory holding secret data.
+type Buffer struct {
+	// mapping is the whole mmap()ed region including the guard pages, nil
+	// if the buffer is on the Go heap
+	mapping []byte
+	// data is the part of the mapping handed out by Bytes()
+	data []byte
+	// locked is false if mlock() failed, for example because RLIMIT_MEMLOCK
+	// is too low. The buffer is still usable.
+	locked bool
+}
+
+// New allocates a zeroed Buffer of "size" bytes. If no mapping can be
+// created, the Buffer is allocated on the Go heap instead.
+func New(size int) *Buffer {
+	if size <= 0 {
+		log.Panicf("securemem: invalid size %d", size)
+	}
+	pageSize := unix.Getpagesize()
+	dataLen := (size + pageSize - 1) / pageSize * pageSize
+	mapping, err := mmap(-1, 0, dataLen+2*pageSize,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err == nil {
+		// Guard pages before and after the data pages
+		err = unix.Mprotect(mapping[:pageSize], unix.PROT_NONE)
+		if err == nil {
+			err = unix.Mprotect(mapping[pageSize+dataLen:], unix.PROT_NONE)
+		}
+		if err != nil {
+			unix.Munmap(mapping)
+		}
+	}
+	if err != nil {
+		log.Printf("securemem: can't allocate locked memory, using the Go heap: %v", err)
+		return &Buffer{data: make([]byte, size)}
+	}
+	dataPages := mapping[pageSize : pageSize+dataLen]
+	b := &Buffer{
+		mapping: mapping,
+		// Align the data to the end of the data pages so that an overflow hits
+		// the trailing guard page.
+		data: dataPages[dataLen-size : dataLen : dataLen],
+	}
+	b.locked = unix.Mlock(dataPages) == nil
+	// Keep keys out of core dumps. Not fatal if unsupported.
+	unix.Madvise(dataPages, unix.MADV_DONTDUMP)
+	return b
+}
+
+// Copy allocates a new Buffer and copies "src" into it. "src" is left
+// untouched.
+func Copy(src []byte) *Buffer {
+	b := New(len(src))
+	copy(b.data, src)
+	return b
+}
+
+// Move is like Copy but also overwrites "src" with zeros.
+func Move(src []byte) *Buffer {
+	b := Copy(src)
+	for i := range src {
+		src[i] = 0
+	}
+	return b
+}
+
+// Bytes returns the content of the buffer. The slice must not be used after
+// Destroy() and must not be appended to.
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+// Len returns the size of the buffer in bytes.
+func (b *Buffer) Len() int {
+	return len(b.data)
+}
+
+// Locked tells whether the buffer is protected from being swapped out.
+func (b *Buffer) Locked() bool {
+	return b.locked
+}
+
+// Destroy overwrites the buffer with zeros and frees it. Calling Destroy on
+// a nil or an already destroyed Buffer is a no-op.
+func (b *Buffer) Destroy() {
+	if b == nil || b.data == nil {
+		return
+	}
+	for i := range b.data {
+		b.data[i] = 0
+	}
+	if b.locked {
+		pageSize := unix.Getpagesize()
+		unix.Munlock(b.mapping[pageSize : len(b.mapping)-pageSize])
+	}
+	if b.mapping != nil {
+		unix.Munmap(b.mapping)
+	}
+	b.mapping = nil
+	b.data = nil
+	b.locked = false
+}
@@ -0,0 +1,76 @@
+package securemem
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNew(t *testing.T) {
+	for _, size := range []int{1, 32, 4096, 4097} {
+		b := New(size)
+		if b.Len() != size || len(b.Bytes()) != size {
+			t.Errorf("size %d: got Len()=%d", size, b.Len())
+		}
+		// The data ends at the trailing guard page, appending must
+		// reallocate instead of writing into it.
+		if cap(b.Bytes()) != size {
+			t.Errorf("size %d: cap=%d", size, cap(b.Bytes()))
+		}
+		if !bytes.Equal(b.Bytes(), make([]byte, size)) {
+			t.Errorf("size %d: buffer is not zeroed", size)
+		}
+		b.Destroy()
+	}
+}
+
+func TestCopyMove(t *testing.T) {
+	src := []byte("0123456789abcdef0123456789abcdef")
+	orig := append([]byte{}, src...)
+
+	b := Copy(src)
+	if !bytes.Equal(b.Bytes(), orig) || !bytes.Equal(src, orig) {
+		t.Error("Copy changed the content")
+	}
+	b.Destroy()
+
+	b = Move(src)
+	if !bytes.Equal(b.Bytes(), orig) {
+		t.Error("Move lost the content")
+	}
+	if !bytes.Equal(src, make([]byte, len(src))) {
+		t.Error("Move did not zero the source")
+	}
+	b.Destroy()
+}
+
+func TestDestroy(t *testing.T) {
+	b := Copy([]byte{1, 2, 3})
+	b.Destroy()
+	if b.Bytes() != nil || b.Len() != 0 || b.Locked() {
+		t.Error("destroyed buffer still holds data")
+	}
+	// Destroying twice or a nil buffer is a no-op
+	b.Destroy()
+	var nilBuf *Buffer
+	nilBuf.Destroy()
+}
+
+// Without a mapping, for example when the address space is limited, buffers
+// are allocated on the heap instead of failing.
+func TestHeapFallback(t *testing.T) {
+	mmap = func(int, int64, int, int, int) ([]byte, error) {
+		return nil, unix.ENOMEM
+	}
+	defer func() { mmap = unix.Mmap }()
+	b := Copy([]byte{1, 2, 3})
+	if !bytes.Equal(b.Bytes(), []byte{1, 2, 3}) || b.Locked() {
+		t.Errorf("got %v, locked=%v", b.Bytes(), b.Locked())
+	}
+	data := b.Bytes()
+	b.Destroy()
+	if !bytes.Equal(data, make([]byte, 3)) || b.Bytes() != nil {
+		t.Error("heap buffer not wiped")
+	}
+}
@@ -0,0 +1,130 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8), byte by
+// byte, like the scheme used by Vault and age-plugin-sss.
+//
+// Each share is the x coordinate (1..255) followed by the values of the
+// random polynomials at x, one per secret byte.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// MaxShares is the maximum number of shares, limited by the field size.
+const MaxShares = 255
+
+var (
+	// ErrInvalidParams is returned by Split for impossible n and k.
+	ErrInvalidParams = errors.New("shamir: invalid number of shares or threshold")
+	// ErrInvalidShares is returned by Combine for malformed or duplicate
+	// shares.
+	ErrInvalidShares = errors.New("shamir: invalid shares")
+)
+
+// Split splits "secret" into "n" shares, any "k" of which reconstruct it.
+func Split(secret []byte, n, k int) ([][]byte, error) {
+	if k < 2 || n < k || n > MaxShares || len(secret) == 0 {
+		return nil, ErrInvalidParams
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+	// coefficients of the polynomial for one byte, coeffs[0] is the secret
+	coeffs := make([]byte, k)
+	defer wipe(coeffs)
+	for b := range secret {
+		coeffs[0] = secret[b]
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			shares[i][b+1] = evaluate(coeffs, shares[i][0])
+		}
+	}
+	return shares, nil
+}
+
+// Combine reconstructs the secret from at least "k" shares returned by
+// Split. With fewer shares, the result is garbage; the caller has to check
+// it.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrInvalidShares
+	}
+	l := len(shares[0])
+	if l < 2 {
+		return nil, ErrInvalidShares
+	}
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if len(s) != l || s[0] == 0 || seen[s[0]] {
+			return nil, ErrInvalidShares
+		}
+		seen[s[0]] = true
+	}
+	secret := make([]byte, l-1)
+	// Lagrange interpolation at x=0
+	for i, si := range shares {
+		xi := si[0]
+		basis := byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			xj := sj[0]
+			// xj / (xj - xi), subtraction is xor
+			basis = mul(basis, div(xj, xj^xi))
+		}
+		for b := range secret {
+			secret[b] ^= mul(si[b+1], basis)
+		}
+	}
+	return secret, nil
+}
+
+// evaluate returns the polynomial with "coeffs" at "x" (Horner's method).
+func evaluate(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// mul multiplies in GF(2^8) with the AES polynomial x^8+x^4+x^3+x+1. Constant
+// time.
+func mul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		// mask is 0xff if the lowest bit of b is set
+		mask := -(b & 1)
+		p ^= a & mask
+		// carry is 0xff if the highest bit of a is set
+		carry := -(a >> 7)
+		a = (a << 1) ^ (0x1b & carry)
+		b >>= 1
+	}
+	return p
+}
+
+// inverse returns a^-1 = a^254 in GF(2^8). inverse(0) is 0.
+func inverse(a byte) byte {
+	r := a
+	for i := 0; i < 6; i++ {
+		r = mul(r, r)
+		r = mul(r, a)
+	}
+	return mul(r, r)
+}
+
+func div(a, b byte) byte {
+	return mul(a, inverse(b))
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,79 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	for _, p := range []struct{ n, k int }{{2, 2}, {3, 2}, {5, 3}, {10, 7}, {MaxShares, 5}} {
+		shares, err := Split(secret, p.n, p.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shares) != p.n {
+			t.Fatalf("n=%d k=%d: got %d shares", p.n, p.k, len(shares))
+		}
+		// Any k consecutive shares, and all of them, reconstruct the secret
+		for _, subset := range [][][]byte{shares[:p.k], shares[p.n-p.k:], shares} {
+			got, err := Combine(subset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, secret) {
+				t.Errorf("n=%d k=%d: wrong secret from %d shares", p.n, p.k, len(subset))
+			}
+		}
+		// k-1 shares give something else
+		got, err := Combine(shares[:p.k-1])
+		if err == nil && bytes.Equal(got, secret) {
+			t.Errorf("n=%d k=%d: secret recovered from %d shares", p.n, p.k, p.k-1)
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	secret := []byte("secret")
+	for _, p := range []struct{ n, k int }{{1, 1}, {3, 1}, {2, 3}, {MaxShares + 1, 2}} {
+		if _, err := Split(secret, p.n, p.k); err != ErrInvalidParams {
+			t.Errorf("n=%d k=%d: got %v", p.n, p.k, err)
+		}
+	}
+	if _, err := Split(nil, 3, 2); err != ErrInvalidParams {
+		t.Errorf("empty secret: got %v", err)
+	}
+}
+
+func TestCombineInvalid(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string][][]byte{
+		"one share":  shares[:1],
+		"duplicate":  {shares[0], shares[0]},
+		"length":     {shares[0], shares[1][:3]},
+		"x zero":     {shares[0], append([]byte{0}, shares[1][1:]...)},
+		"empty data": {{1}, {2}},
+	}
+	for name, s := range invalid {
+		if _, err := Combine(s); err != ErrInvalidShares {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if mul(byte(a), inverse(byte(a))) != 1 {
+			t.Fatalf("inverse(%d) is wrong", a)
+		}
+	}
+	// 0x53 * 0xca = 1 in the AES field
+	if mul(0x53, 0xca) != 1 {
+		t.Error("mul(0x53, 0xca) != 1")
+	}
+}
@@ -7,10 +7,14 @@ import (
 	"log"
 
 	"github.com/aperturerobotics/jacobsa-crypto/siv"
+
+	"libgocryptfs/v2/internal/securemem"
 )
 
 type sivAead struct {
 	key []byte
+	// keyBuf holds the memory behind "key"
+	keyBuf *securemem.Buffer
 }
 
 var _ cipher.AEAD = &sivAead{}
@@ -39,9 +43,10 @@ func New(key []byte) cipher.AEAD {
 // Same as "New" without the 64-byte restriction.
 func new2(keyIn []byte) cipher.AEAD {
 	// Create a private copy so the caller can zero the one he owns
-	key := append([]byte{}, keyIn...)
+	keyBuf := securemem.Copy(keyIn)
 	return &sivAead{
-		key: key,
+		key:    keyBuf.Bytes(),
+		keyBuf: keyBuf,
 	}
 }
 
@@ -99,4 +104,5 @@ func (s *sivAead) Wipe() {
 		s.key[i] = 0
 	}
 	s.key = nil
+	s.keyBuf.Destroy()
 }
@@ -0,0 +1,87 @@
+// Package speed benchmarks the content encryption backends, like
+// "gocryptfs -speed".
+package speed
+
+import (
+	"time"
+
+	"libgocryptfs/v2/internal/cryptocore"
+	"libgocryptfs/v2/internal/stupidgcm"
+)
+
+// 128-bit file ID + 64 bit block number = 192 bits = 24 bytes
+const adLen = 24
+
+// gocryptfs uses fixed-size 4 kiB blocks
+const gocryptfsBlockSize = 4096
+
+// Result is the measurement for one backend.
+type Result struct {
+	// Backend is the backend name, like "AES-GCM-256-OpenSSL"
+	Backend string
+	// MBPerSec is the encryption throughput in MB/s
+	MBPerSec float64
+	// Preferred is set for the backend selected by default for its
+	// algorithm on this device
+	Preferred bool
+}
+
+// Run measures the encryption speed of each backend in "backends" during
+// "duration" and returns the results in the same order.
+func Run(backends []cryptocore.AEADTypeEnum, duration time.Duration) []Result {
+	results := make([]Result, len(backends))
+	for i, b := range backends {
+		results[i] = Result{
+			Backend:   b.String(),
+			MBPerSec:  measure(b, duration),
+			Preferred: isPreferred(b),
+		}
+	}
+	return results
+}
+
+// isPreferred tells if "b" is the backend registerNewVolume selects for its
+// algorithm.
+func isPreferred(b cryptocore.AEADTypeEnum) bool {
+	switch b {
+	case cryptocore.BackendOpenSSL:
+		return stupidgcm.PreferOpenSSLAES256GCM()
+	case cryptocore.BackendGoGCM:
+		return !stupidgcm.PreferOpenSSLAES256GCM()
+	case cryptocore.BackendXChaCha20Poly1305OpenSSL:
+		return stupidgcm.PreferOpenSSLXchacha20poly1305()
+	case cryptocore.BackendXChaCha20Poly1305:
+		return !stupidgcm.PreferOpenSSLXchacha20poly1305()
+	}
+	// AES-SIV has a single implementation
+	return true
+}
+
+// measure encrypts 4 kiB blocks with backend "b" through cryptocore during
+// "duration" and returns the throughput in MB/s.
+func measure(b cryptocore.AEADTypeEnum, duration time.Duration) float64 {
+	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	cc := cryptocore.New(key, b, b.NonceSize*8, true)
+	defer cc.Wipe()
+	c := cc.AEADCipher
+	authData := make([]byte, adLen)
+	iv := make([]byte, c.NonceSize())
+	in := make([]byte, gocryptfsBlockSize)
+	dst := make([]byte, len(in)+len(iv)+c.Overhead())
+	copy(dst, iv)
+	var n int
+	start := time.Now()
+	for {
+		// Check the time every 64 blocks only
+		for i := 0; i < 64; i++ {
+			// Reset dst buffer
+			dst = dst[:len(iv)]
+			// Encrypt and append to nonce
+			c.Seal(dst, iv, in, authData)
+		}
+		n += 64
+		if elapsed := time.Since(start); elapsed >= duration {
+			return float64(n*gocryptfsBlockSize) / 1e6 / elapsed.Seconds()
+		}
+	}
+}
@@ -5,6 +5,8 @@ package stupidgcm
 
 import (
 	"log"
+
+	"libgocryptfs/v2/internal/securemem"
 )
 
 /*
@@ -13,8 +15,11 @@ import (
 import "C"
 
 type stupidAEADCommon struct {
-	wiped            bool
-	key              []byte
+	wiped bool
+	key   []byte
+	// keyBuf holds the memory behind "key" if it was allocated with
+	// securemem. nil otherwise.
+	keyBuf           *securemem.Buffer
 	openSSLEVPCipher *C.EVP_CIPHER
 	nonceSize        int
 }
@@ -58,6 +63,8 @@ func (c *stupidAEADCommon) Wipe() {
 	for i := range key {
 		key[i] = 0
 	}
+	c.keyBuf.Destroy()
+	c.keyBuf = nil
 }
 
 func (c *stupidAEADCommon) Wiped() bool {
@@ -9,6 +9,8 @@ import "C"
 import (
 	"crypto/cipher"
 	"log"
+
+	"libgocryptfs/v2/internal/securemem"
 )
 
 const (
@@ -31,10 +33,13 @@ func NewAES256GCM(keyIn []byte) cipher.AEAD {
 	if len(keyIn) != keyLen {
 		log.Panicf("Only %d-byte keys are supported", keyLen)
 	}
+	// Create a private copy of the key. This instance lives as long as the
+	// volume is opened, so keep the key out of the Go heap.
+	keyBuf := securemem.Copy(keyIn)
 	return &stupidGCM{
 		stupidAEADCommon{
-			// Create a private copy of the key
-			key:              append([]byte{}, keyIn...),
+			key:              keyBuf.Bytes(),
+			keyBuf:           keyBuf,
 			openSSLEVPCipher: C.EVP_aes_256_gcm(),
 			nonceSize:        ivLen,
 		},
@@ -0,0 +1,40 @@
+//go:build without_openssl
+// +build without_openssl
+
+package stupidgcm
+
+import (
+	"crypto/cipher"
+	"log"
+)
+
+const (
+	// BuiltWithoutOpenssl indicates if openssl been disabled at compile-time
+	BuiltWithoutOpenssl = true
+)
+
+// errPanic is called when one of the OpenSSL backends is requested although
+// we have been built without OpenSSL. The callers check BuiltWithoutOpenssl
+// first, so this is a bug. We don't os.Exit() like gocryptfs does because we
+// run inside the host process.
+func errPanic() {
+	log.Panic("BUG: libgocryptfs has been compiled without openssl support but you are still trying to use openssl")
+}
+
+// NewAES256GCM is a stub that panics. See errPanic.
+func NewAES256GCM(_ []byte) cipher.AEAD {
+	errPanic()
+	return nil
+}
+
+// NewChacha20poly1305 is a stub that panics. See errPanic.
+func NewChacha20poly1305(_ []byte) cipher.AEAD {
+	errPanic()
+	return nil
+}
+
+// NewXchacha20poly1305 is a stub that panics. See errPanic.
+func NewXchacha20poly1305(_ []byte) cipher.AEAD {
+	errPanic()
+	return nil
+}
@@ -54,6 +54,15 @@ func Renameat(olddirfd int, oldpath string, newdirfd int, newpath string) (err e
 	return err
 }
 
+// Renameat2 wraps the Renameat2 syscall.
+// Retries on EINTR.
+func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) (err error) {
+	err = retryEINTR(func() error {
+		return unix.Renameat2(olddirfd, oldpath, newdirfd, newpath, flags)
+	})
+	return err
+}
+
 // Unlinkat syscall.
 // Retries on EINTR.
 func Unlinkat(dirfd int, path string, flags int) (err error) {
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"C"
+	"time"
+
+	"libgocryptfs/v2/internal/configfile"
+)
+
+// kdfParams is returned as JSON by gcf_calibrate_kdf.
+type kdfParams struct {
+	// KDF is the key derivation function the parameters are for. Only
+	// "scrypt" is supported for now.
+	KDF  string
+	LogN int
+	R    int
+	P    int
+	// MemoryBytes is the memory needed to unlock the volume
+	MemoryBytes uint64
+	// DurationMs is the time the key derivation took on this device
+	DurationMs int64
+}
+
+// gcf_calibrate_kdf measures the password key derivation on this device and
+// returns the highest cost parameters that take at most "targetMs"
+// milliseconds and need at most "maxMemoryMB" MiB of memory (0 means no
+// limit), as a JSON object with the fields KDF, LogN, R, P, MemoryBytes and
+// DurationMs. LogN can be passed to gcf_create_volume and
+// gcf_change_password_with_cost.
+//
+// The measurement takes up to about twice "targetMs". Returns NULL if
+// "targetMs" is not positive. The host must free the returned string.
+//
+//export gcf_calibrate_kdf
+func gcf_calibrate_kdf(targetMs int, maxMemoryMB int) *C.char {
+	if targetMs <= 0 || maxMemoryMB < 0 {
+		return nil
+	}
+	res := configfile.CalibrateScrypt(time.Duration(targetMs)*time.Millisecond, uint64(maxMemoryMB)<<20)
+	kdf := configfile.NewScryptKDF(res.LogN)
+	return infoJSON(kdfParams{
+		KDF:         "scrypt",
+		LogN:        res.LogN,
+		R:           kdf.R,
+		P:           kdf.P,
+		MemoryBytes: res.Memory,
+		DurationMs:  res.Duration.Milliseconds(),
+	})
+}
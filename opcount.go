@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// opCount tracks the API calls currently running on a Volume. gcf_close uses
+// it to stop admitting new operations and to wait for the in-flight ones
+// before file descriptors are closed and keys are wiped.
+type opCount struct {
+	sync.Mutex
+	// closing is set once the volume started to close. begin() fails
+	// afterwards.
+	closing bool
+	// Number of operations between begin() and end()
+	inFlight int
+	// drained is closed by end() when the last in-flight operation of a
+	// closing volume returns.
+	drained chan struct{}
+}
+
+// begin registers a new operation. It returns false if the volume is closing,
+// in which case the caller must not touch the volume and must not call end().
+func (o *opCount) begin() bool {
+	o.Lock()
+	defer o.Unlock()
+	if o.closing {
+		return false
+	}
+	o.inFlight++
+	return true
+}
+
+// end marks an operation started with begin() as finished.
+func (o *opCount) end() {
+	o.Lock()
+	defer o.Unlock()
+	o.inFlight--
+	if o.closing && o.inFlight == 0 && o.drained != nil {
+		close(o.drained)
+		o.drained = nil
+	}
+}
+
+// startClosing makes begin() fail from now on. It returns false if the volume
+// was already closing.
+func (o *opCount) startClosing() bool {
+	o.Lock()
+	defer o.Unlock()
+	if o.closing {
+		return false
+	}
+	o.closing = true
+	return true
+}
+
+// cancelClosing reverts startClosing(), new operations are admitted again.
+func (o *opCount) cancelClosing() {
+	o.Lock()
+	defer o.Unlock()
+	o.closing = false
+	o.drained = nil
+}
+
+// wait blocks until all in-flight operations have returned or until
+// "timeout" expired. A negative timeout waits forever.
+// Returns true if the volume is idle.
+// Must be called after startClosing().
+func (o *opCount) wait(timeout time.Duration) bool {
+	o.Lock()
+	if o.inFlight == 0 {
+		o.Unlock()
+		return true
+	}
+	if o.drained == nil {
+		o.drained = make(chan struct{})
+	}
+	drained := o.drained
+	o.Unlock()
+	if timeout < 0 {
+		<-drained
+		return true
+	}
+	select {
+	case <-drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// whenIdle runs "f" in a new goroutine as soon as all in-flight operations
+// have returned.
+// Must be called after startClosing().
+func (o *opCount) whenIdle(f func()) {
+	go func() {
+		o.wait(-1)
+		f()
+	}()
+}
+
+// busy returns true if operations are running.
+func (o *opCount) busy() bool {
+	o.Lock()
+	defer o.Unlock()
+	return o.inFlight > 0
+}
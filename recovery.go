@@ -0,0 +1,135 @@
+package main
+
+import (
+	"C"
+	"encoding/base64"
+	"path/filepath"
+
+	"libgocryptfs/v2/internal/configfile"
+)
+
+// recoveryRecipientInfo is returned as JSON by gcf_list_recovery_recipients.
+type recoveryRecipientInfo struct {
+	Label string
+	// PublicKey is the base64-encoded X25519 public key
+	PublicKey string
+}
+
+// gcf_generate_recovery_key generates a new X25519 recovery key pair and
+// copies the 32-byte private and public keys to the given buffers, which
+// must be at least 32 bytes long.
+//
+//export gcf_generate_recovery_key
+func gcf_generate_recovery_key(privateKeyBuff, publicKeyBuff []byte) bool {
+	if len(privateKeyBuff) < 32 || len(publicKeyBuff) < 32 {
+		return false
+	}
+	private, public, err := configfile.GenerateRecoveryKey()
+	if err != nil {
+		return false
+	}
+	copy(privateKeyBuff, private.Bytes())
+	copy(publicKeyBuff, public)
+	private.Destroy()
+	return true
+}
+
+// gcf_add_recovery_recipient adds a copy of the master key of the volume in
+// "rootCipherDir" encrypted to the X25519 "publicKey", so that the volume can
+// be opened with the matching private key and gcf_init_with_recovery_key.
+// "label" describes the recipient. Unlocking needs "password", or
+// "givenScryptHash" if not empty.
+//
+// Returns the same codes as gcf_verify_password, and -1 if "publicKey" is
+// invalid or already a recipient, or if the config file has no MAC. Volumes
+// created by gocryptfs need gcf_migrate_config_mac first.
+//
+//export gcf_add_recovery_recipient
+func gcf_add_recovery_recipient(rootCipherDir string, password, givenScryptHash, publicKey []byte, label string) int {
+	return updateRecoveryRecipients(rootCipherDir, password, givenScryptHash, func(cf *configfile.ConfFile, masterkey []byte) error {
+		return cf.AddRecoveryRecipient(masterkey, publicKey, label)
+	})
+}
+
+// gcf_remove_recovery_recipient removes the recovery recipient with the
+// X25519 "publicKey" from the volume in "rootCipherDir".
+//
+// Returns the same codes as gcf_add_recovery_recipient.
+//
+//export gcf_remove_recovery_recipient
+func gcf_remove_recovery_recipient(rootCipherDir string, password, givenScryptHash, publicKey []byte) int {
+	return updateRecoveryRecipients(rootCipherDir, password, givenScryptHash, func(cf *configfile.ConfFile, masterkey []byte) error {
+		return cf.RemoveRecoveryRecipient(publicKey)
+	})
+}
+
+// updateRecoveryRecipients unlocks the volume, calls "update" and writes the
+// config file.
+func updateRecoveryRecipients(rootCipherDir string, password, givenScryptHash []byte, update func(cf *configfile.ConfFile, masterkey []byte) error) int {
+	defer wipe(password)
+	if rekeyPending(rootCipherDir) {
+		return -1
+	}
+	cf, masterkey, errCode := unlockMasterkey(rootCipherDir, password, givenScryptHash, nil)
+	if errCode != 0 {
+		return errCode
+	}
+	defer masterkey.Destroy()
+	if !cf.HasMAC() {
+		// Recovery keys only work with authenticated configs
+		return -1
+	}
+	if update(cf, masterkey.Bytes()) != nil {
+		return -1
+	}
+	cf.SetMAC(masterkey.Bytes())
+	if cf.WriteFile() != nil {
+		return -1
+	}
+	return 0
+}
+
+// gcf_list_recovery_recipients returns the recovery recipients of the volume
+// in "rootCipherDir" as a JSON array of objects with the fields Label and
+// PublicKey (base64). Returns NULL if the config file can't be loaded. The
+// host must free the returned string.
+//
+//export gcf_list_recovery_recipients
+func gcf_list_recovery_recipients(rootCipherDir string) *C.char {
+	cf, err := configfile.Load(filepath.Join(rootCipherDir, configfile.ConfDefaultName))
+	if err != nil {
+		return nil
+	}
+	recipients := make([]recoveryRecipientInfo, len(cf.RecoveryRecipients))
+	for i, r := range cf.RecoveryRecipients {
+		recipients[i] = recoveryRecipientInfo{
+			Label:     r.Label,
+			PublicKey: base64.StdEncoding.EncodeToString(r.PublicKey),
+		}
+	}
+	return infoJSON(recipients)
+}
+
+// gcf_init_with_recovery_key opens the volume in "rootCipherDir" with the
+// X25519 "privateKey" of one of its recovery recipients instead of the
+// password, and returns the volume ID. "privateKey" is wiped.
+//
+// Returns -1 if the config file can't be loaded, -2 if the key is not a
+// recipient of the volume, -4 if the config file has been tampered with or
+// has no MAC, and -5 like gcf_init during a re-key.
+//
+//export gcf_init_with_recovery_key
+func gcf_init_with_recovery_key(rootCipherDir string, privateKey []byte) int {
+	defer wipe(privateKey)
+	cf, err := configfile.Load(filepath.Join(rootCipherDir, configfile.ConfDefaultName))
+	if err != nil {
+		return -1
+	}
+	masterkey, err := cf.DecryptMasterKeyWithRecoveryKey(privateKey)
+	if err != nil {
+		return unlockErrCode(err)
+	}
+	volumeID := registerNewVolume(rootCipherDir, masterkey.Bytes(), cf, &openOptions{})
+	masterkey.Destroy()
+	return volumeID
+}
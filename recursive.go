@@ -0,0 +1,160 @@
+package main
+
+import (
+	"C"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"libgocryptfs/v2/internal/syscallcompat"
+)
+
+// removeTree deletes "relPath" and, if it is a directory, everything below.
+// It continues after errors and returns the plaintext paths that could not be
+// removed. "progress" is called after every entry with the number of entries
+// removed so far. The error is ECANCELED if it returned false.
+func (volume *Volume) removeTree(relPath string, progress progressFunc) ([]string, error) {
+	mode, _, _, err := volume.stat(relPath)
+	if err != nil {
+		return nil, err
+	}
+	if mode&syscall.S_IFMT != syscall.S_IFDIR {
+		err = volume.removeFile(relPath)
+		if err != nil {
+			return []string{relPath}, err
+		}
+		progress(1, 1)
+		return nil, nil
+	}
+	// Count the entries for progress reporting, "relPath" itself included
+	total := uint64(1)
+	err = volume.walkTree(relPath, func(e *walkEntry) error {
+		total++
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !progress(0, total) {
+		return nil, syscall.ECANCELED
+	}
+	// Cached directory fds may point to deleted directories afterwards
+	defer volume.dirCache.Clear()
+
+	var done uint64
+	var failed []string
+	remove := func(e *walkEntry) error {
+		var err error
+		if !e.isDir() {
+			err = volume.unlinkAt(e.dirfd, e.cName)
+		} else if e.err != nil {
+			err = e.err
+		} else {
+			err = volume.rmdirAt(e.dirfd, e.cName)
+		}
+		if err != nil {
+			failed = append(failed, e.path)
+		} else {
+			volume.indexRemove(e.path)
+		}
+		done++
+		if !progress(done, total) {
+			return syscall.ECANCELED
+		}
+		return nil
+	}
+	// Files are removed when entering, directories when leaving them
+	err = volume.walkTree(relPath, func(e *walkEntry) error {
+		if e.isDir() {
+			return nil
+		}
+		return remove(e)
+	}, remove)
+	if err != nil {
+		return failed, err
+	}
+	parentDirFd, cName, err := volume.prepareAtSyscall(relPath)
+	if err == nil {
+		err = volume.rmdirAt(parentDirFd, cName)
+		syscall.Close(parentDirFd)
+	}
+	if err != nil {
+		failed = append(failed, relPath)
+		return failed, err
+	}
+	volume.indexRemove(relPath)
+	progress(total, total)
+	if len(failed) > 0 {
+		return failed, syscall.ENOTEMPTY
+	}
+	return nil, nil
+}
+
+// move renames "srcPath" to "dstPath", which must not exist. If they are on
+// different filesystems (for example when a bind mount lives inside the
+// ciphertext directory), the tree is copied and the source removed.
+func (volume *Volume) move(srcPath, dstPath string, progress progressFunc) ([]string, error) {
+	err := volume.rename(srcPath, dstPath, syscallcompat.RENAME_NOREPLACE)
+	if err != syscall.EXDEV {
+		return nil, err
+	}
+	c := copier{
+		src:      volume,
+		dst:      volume,
+		progress: progress,
+	}
+	err = c.copyTree(srcPath, dstPath, true)
+	if err != nil {
+		return nil, err
+	}
+	return volume.removeTree(srcPath, func(done, total uint64) bool { return true })
+}
+
+// failedPaths returns the NUL-separated list of "paths" as a C string, or NULL
+// if the list is empty.
+func failedPaths(paths []string) *C.char {
+	if len(paths) == 0 {
+		return nil
+	}
+	return C.CString(strings.Join(paths, "\x00") + "\x00")
+}
+
+// gcf_remove_recursive deletes "relPath" and, if it is a directory,
+// everything below. The ciphertext tree is walked with directory fds instead
+// of resolving every path.
+//
+// Errors do not stop the removal. The paths that could not be removed are
+// returned as a NUL-separated list (NULL if there are none), which the host
+// must free.
+//
+// "progressCallback" may be NULL. Otherwise it is called like in
+// gcf_copy_file, with "done" and "total" counting entries. Returning non-zero
+// stops the removal, the entries removed so far stay removed.
+//
+//export gcf_remove_recursive
+func gcf_remove_recursive(sessionID int, relPath string, progressCallback unsafe.Pointer) (bool, *C.char) {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return false, nil
+	}
+	defer volume.release()
+	failed, err := volume.removeTree(relPath, hostProgress(progressCallback, sessionID))
+	return err == nil, failedPaths(failed)
+}
+
+// gcf_move moves "srcPath" to "dstPath", which must not exist. This is a
+// rename, unless the two paths are on different filesystems: then the tree is
+// copied like gcf_copy_file (progress is reported in bytes) and the source is
+// removed like gcf_remove_recursive. The second return value lists the
+// source paths that could not be removed after the copy.
+//
+//export gcf_move
+func gcf_move(sessionID int, srcPath, dstPath string, progressCallback unsafe.Pointer) (bool, *C.char) {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return false, nil
+	}
+	defer volume.release()
+	failed, err := volume.move(srcPath, dstPath, hostProgress(progressCallback, sessionID))
+	return err == nil, failedPaths(failed)
+}
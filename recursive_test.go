@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// makeTestTree creates a tree below "root" with long names, empty files and
+// an empty directory, and returns the number of entries below "root".
+func makeTestTree(t *testing.T, volumeID int, root string) int {
+	t.Helper()
+	long := strings.Repeat("l", 200)
+	for _, dir := range []string{root, root + "/a", root + "/a/empty", root + "/" + long} {
+		if !gcf_mkdir(volumeID, dir, 0700) {
+			t.Fatalf("can't create %q", dir)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		writeTestFile(t, volumeID, root+"/a/f"+strings.Repeat("z", i*10), nil)
+	}
+	writeTestFile(t, volumeID, root+"/"+long+"/f", []byte("content"))
+	return 24
+}
+
+func TestRemoveRecursive(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	entries := makeTestTree(t, volumeID, "/r")
+	writeTestFile(t, volumeID, "/keep", []byte("k"))
+	// Cache a directory that is about to be deleted
+	gcf_list_dir(volumeID, "/r/a/empty")
+
+	var last, total uint64
+	failed, err := getVolume(t, volumeID).removeTree("/r", func(done, t uint64) bool {
+		last, total = done, t
+		return true
+	})
+	if err != nil || failed != nil {
+		t.Fatalf("removeTree: %v, %v", failed, err)
+	}
+	if total != uint64(entries+1) || last != total {
+		t.Errorf("progress: %d of %d", last, total)
+	}
+	if _, _, _, ok := gcf_get_attrs(volumeID, "/r"); ok {
+		t.Fatal("tree still exists")
+	}
+	entriesLeft, _ := getVolume(t, volumeID).listDir("/", true)
+	if len(entriesLeft) != 1 || entriesLeft[0].name != "keep" {
+		t.Fatalf("left behind: %v", entriesLeft)
+	}
+	// No stale directory fd is used for the new tree
+	makeTestTree(t, volumeID, "/r")
+
+	if ok, failedPaths := gcf_remove_recursive(volumeID, "/keep", nil); !ok || failedPaths != nil {
+		t.Error("single file not removed")
+	}
+	if ok, _ := gcf_remove_recursive(volumeID, "/missing", nil); ok {
+		t.Error("removed a missing path")
+	}
+}
+
+func TestRemoveRecursiveFailures(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	makeTestTree(t, volumeID, "/r")
+	// An entry that can't be decrypted keeps its directory
+	gcf_mkdir(volumeID, "/r/b", 0700)
+	writeTestFile(t, volumeID, "/r/b/corrupt", nil)
+	volume := getVolume(t, volumeID)
+	parentfd, cName, _ := volume.prepareAtSyscall("/r/b/corrupt")
+	syscall.Renameat(parentfd, cName, parentfd, "garbage")
+	syscall.Close(parentfd)
+	volume.dirCache.Clear()
+
+	failed, err := volume.removeTree("/r", func(done, total uint64) bool { return true })
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if strings.Join(failed, ",") != "/r/b,/r" {
+		t.Errorf("failed paths: %v", failed)
+	}
+	// Everything else is gone
+	if _, _, _, ok := gcf_get_attrs(volumeID, "/r/a"); ok {
+		t.Error("/r/a still exists")
+	}
+}
+
+func TestRemoveRecursiveCancel(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	makeTestTree(t, volumeID, "/r")
+	_, err := getVolume(t, volumeID).removeTree("/r", func(done, total uint64) bool {
+		return done < 5
+	})
+	if err != syscall.ECANCELED {
+		t.Fatalf("got %v", err)
+	}
+	// The entries removed so far stay removed, the rest is left
+	if _, _, _, ok := gcf_get_attrs(volumeID, "/r"); !ok {
+		t.Error("tree removed completely")
+	}
+	if ok, _ := gcf_remove_recursive(volumeID, "/r", nil); !ok {
+		t.Error("can't remove the rest")
+	}
+}
+
+func TestMove(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	makeTestTree(t, volumeID, "/r")
+	gcf_mkdir(volumeID, "/dst", 0700)
+	if ok, _ := gcf_move(volumeID, "/r", "/dst", nil); ok {
+		t.Fatal("replaced an existing directory")
+	}
+	if ok, failed := gcf_move(volumeID, "/r", "/dst/r", nil); !ok || failed != nil {
+		t.Fatal("gcf_move failed")
+	}
+	long := strings.Repeat("l", 200)
+	if string(readTestFile(t, volumeID, "/dst/r/"+long+"/f", 10)) != "content" {
+		t.Error("moved file differs")
+	}
+	if _, _, _, ok := gcf_get_attrs(volumeID, "/r"); ok {
+		t.Error("source still exists")
+	}
+}
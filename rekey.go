@@ -0,0 +1,499 @@
+package main
+
+import (
+	"C"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"libgocryptfs/v2/internal/configfile"
+	"libgocryptfs/v2/internal/nametransform"
+	"libgocryptfs/v2/internal/securemem"
+	"libgocryptfs/v2/internal/syscallcompat"
+)
+
+// A re-key copies the whole volume, re-encrypted under a new master key, to
+// the staging directory rekeyDirName inside the ciphertext directory, then
+// switches to it. The state is kept on disk so that an interrupted re-key
+// resumes where it stopped:
+//
+//  1. Copying: the staging directory holds the new config file and the
+//     entries copied so far. The old config file is in use.
+//  2. Switching: the old ciphertext entries are moved to rekeyOldDirName,
+//     then the new config file is moved to the root. This is the commit
+//     point.
+//  3. Finishing: the new ciphertext entries are moved from the staging
+//     directory to the root and the old ones are deleted.
+const (
+	rekeyDirName    = "gocryptfs.rekey"
+	rekeyOldDirName = "gocryptfs.rekey.old"
+	// rekeyPartialName is the ciphertext name, in the root of the staging
+	// directory, files are copied to before being renamed to their final
+	// name, so that an interrupted copy is not mistaken for a complete one
+	rekeyPartialName = "gocryptfs.rekey.partial"
+)
+
+// inodeKey identifies a ciphertext file, to find its hard links.
+type inodeKey struct {
+	dev, ino uint64
+}
+
+// rekeyer copies the content of a volume to its staging volume, skipping the
+// entries copied by an interrupted run.
+type rekeyer struct {
+	copier
+	// links maps the source files with several hard links to the first path
+	// they have been copied to
+	links map[inodeKey]string
+}
+
+func (r *rekeyer) copyDir(dirPath string) error {
+	entries, err := r.src.listDir(dirPath, false)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := path.Join(dirPath, e.name)
+		mode, size, _, err := r.src.stat(p)
+		if err != nil {
+			return err
+		}
+		_, _, _, err = r.dst.stat(p)
+		exists := err == nil
+		if err != nil && err != syscall.ENOENT {
+			return err
+		}
+		switch mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			if !exists {
+				if err = r.dst.mkdir(p, 0700); err != nil {
+					return err
+				}
+			}
+			if err = r.copyDir(p); err != nil {
+				return err
+			}
+			err = r.setDirMode(p, mode)
+		case syscall.S_IFREG:
+			var first string
+			first, err = r.linkedTo(p)
+			if err != nil {
+				return err
+			}
+			if exists || first != "" {
+				if !exists {
+					err = r.link(first, p)
+				}
+				r.done += size
+				if err == nil && !r.progress(r.done, r.total) {
+					err = syscall.ECANCELED
+				}
+				break
+			}
+			err = r.copyFileVia(p, mode)
+		case syscall.S_IFLNK:
+			if !exists {
+				err = r.copySymlink(p, p)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkedTo returns the path a hard link of the regular file "p" has been
+// copied to, if any. Otherwise, "p" is recorded as the first path of the
+// file if it has several links.
+func (r *rekeyer) linkedTo(p string) (string, error) {
+	dirfd, cName, err := r.src.prepareAtSyscall(p)
+	if err != nil {
+		return "", err
+	}
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	syscall.Close(dirfd)
+	if err != nil || st.Nlink < 2 {
+		return "", err
+	}
+	key := inodeKey{dev: uint64(st.Dev), ino: st.Ino}
+	if first, ok := r.links[key]; ok {
+		return first, nil
+	}
+	if r.links == nil {
+		r.links = make(map[inodeKey]string)
+	}
+	r.links[key] = p
+	return "", nil
+}
+
+// link creates "p" in the staging volume as a hard link to "first".
+func (r *rekeyer) link(first, p string) error {
+	dirfd, cName, err := r.dst.prepareAtSyscall(first)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	dirfd2, cName2, err := r.dst.prepareAtSyscall(p)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd2)
+	if !r.dst.plainTextNames && nametransform.IsLongContent(cName2) {
+		// The .name file may be left over by an interrupted run
+		nametransform.DeleteLongNameAt(dirfd2, cName2)
+		if err = r.dst.nameTransform.WriteLongNameAt(dirfd2, cName2, p); err != nil {
+			return err
+		}
+	}
+	return unix.Linkat(dirfd, cName, dirfd2, cName2, 0)
+}
+
+// copyFileVia copies the regular file "p" like copier.copyFile, but through
+// rekeyPartialName, which is renamed to the final ciphertext name once the
+// content is complete.
+func (r *rekeyer) copyFileVia(p string, mode uint32) error {
+	rootfd, err := syscall.Open(r.dst.rootCipherDir, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(rootfd)
+	// Left over by an interrupted run
+	err = syscallcompat.Unlinkat(rootfd, rekeyPartialName, 0)
+	if err != nil && err != syscall.ENOENT {
+		return err
+	}
+
+	dirfd, cName, err := r.src.prepareAtSyscallMyself(p)
+	if err != nil {
+		return err
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	syscall.Close(dirfd)
+	if err != nil {
+		return err
+	}
+	srcFile := os.NewFile(uintptr(fd), cName)
+	defer srcFile.Close()
+
+	fd, err = syscallcompat.Openat(rootfd, rekeyPartialName, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	dstFile := os.NewFile(uintptr(fd), rekeyPartialName)
+	err = r.copyContent(srcFile, dstFile)
+	if err == nil {
+		// The mode passed to open() is subject to the umask
+		err = syscall.Fchmod(fd, mode&07777)
+	}
+	if err2 := dstFile.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(rootfd, rekeyPartialName, 0)
+		return err
+	}
+
+	dirfd, cName, err = r.dst.prepareAtSyscall(p)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	if !r.dst.plainTextNames && nametransform.IsLongContent(cName) {
+		// The .name file may be left over by an interrupted run
+		nametransform.DeleteLongNameAt(dirfd, cName)
+		if err = r.dst.nameTransform.WriteLongNameAt(dirfd, cName, p); err != nil {
+			return err
+		}
+	}
+	return syscallcompat.Renameat(rootfd, rekeyPartialName, dirfd, cName)
+}
+
+// rekeyPending tells if a re-key of the volume in "rootCipherDir" has been
+// started and not finished.
+func rekeyPending(rootCipherDir string) bool {
+	for _, name := range []string{rekeyDirName, rekeyOldDirName} {
+		if _, err := os.Lstat(filepath.Join(rootCipherDir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// lockRoot takes a flock(2) lock of type "how" (syscall.LOCK_SH or
+// syscall.LOCK_EX) on the ciphertext directory, so that volumes opened by
+// other processes are seen. Fails with syscall.EWOULDBLOCK if a conflicting
+// lock is held. Returns nil without error on file systems that don't support
+// locking. The lock is released by closing the returned file.
+func lockRoot(rootCipherDir string, how int) (*os.File, error) {
+	f, err := os.Open(rootCipherDir)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, err
+	} else if err != nil {
+		f.Close()
+		return nil, nil
+	}
+	return f, nil
+}
+
+// volumeIsOpen tells if the volume in "rootCipherDir" is opened in this
+// process. Other processes are detected by lockRoot.
+func volumeIsOpen(rootCipherDir string) bool {
+	open := false
+	OpenedVolumes.Range(func(key, value interface{}) bool {
+		if filepath.Clean(value.(*Volume).rootCipherDir) == filepath.Clean(rootCipherDir) {
+			open = true
+		}
+		return !open
+	})
+	return open
+}
+
+// rekeyCopy runs the copying phase, starting or resuming it.
+func rekeyCopy(rootCipherDir string, password []byte, logN int, returnedScryptHashBuff []byte, progress progressFunc) int {
+	stagingDir := filepath.Join(rootCipherDir, rekeyDirName)
+	oldCf, oldKey, errCode := unlockMasterkey(rootCipherDir, password, nil, nil)
+	if errCode != 0 {
+		return errCode
+	}
+	defer oldKey.Destroy()
+	if logN == 0 {
+		logN = oldCf.ScryptObject.LogN()
+	}
+
+	newCf, newKey, errCode := rekeyStaging(oldCf, stagingDir, password, logN, returnedScryptHashBuff)
+	if errCode != 0 {
+		return errCode
+	}
+	defer newKey.Destroy()
+
+	src, err := newVolume(rootCipherDir, oldKey.Bytes(), oldCf, &openOptions{})
+	if err != nil {
+		return -1
+	}
+	defer src.wipe()
+	dst, err := newVolume(stagingDir, newKey.Bytes(), newCf, &openOptions{})
+	if err != nil {
+		return -1
+	}
+	defer dst.wipe()
+	r := rekeyer{copier: copier{src: src, dst: dst, progress: progress}}
+	r.total, err = src.treeSize("/")
+	if err != nil {
+		return -1
+	}
+	if !progress(0, r.total) {
+		return -6
+	}
+	err = r.copyDir("/")
+	if err == syscall.ECANCELED {
+		return -6
+	} else if err != nil {
+		return -1
+	}
+	return 0
+}
+
+// rekeyStaging creates the staging directory with the new config file, or
+// unlocks the existing one when resuming.
+func rekeyStaging(oldCf *configfile.ConfFile, stagingDir string, password []byte, logN int, returnedScryptHashBuff []byte) (*configfile.ConfFile, *securemem.Buffer, int) {
+	stagingConf := filepath.Join(stagingDir, configfile.ConfDefaultName)
+	if newCf, err := configfile.Load(stagingConf); err == nil {
+		newKey, err := newCf.GetMasterkey(password, nil, returnedScryptHashBuff)
+		if err != nil {
+			return nil, nil, unlockErrCode(err)
+		}
+		return newCf, newKey, 0
+	}
+	// Start over, a staging directory without config file is useless
+	if removeAllForce(stagingDir) != nil || os.Mkdir(stagingDir, 0700) != nil {
+		return nil, nil, -1
+	}
+	newCf, newKey, err := oldCf.Rekeyed(stagingConf, password, logN, returnedScryptHashBuff)
+	if err != nil {
+		return nil, nil, -1
+	}
+	if newCf.IsFeatureFlagSet(configfile.FlagDirIV) {
+		var dirfd int
+		dirfd, err = syscall.Open(stagingDir, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+		if err == nil {
+			err = nametransform.WriteDirIVAt(dirfd)
+			syscall.Close(dirfd)
+		}
+	}
+	if err == nil {
+		// Written last: its presence means that the staging directory is
+		// ready
+		err = newCf.WriteFile()
+	}
+	if err != nil {
+		newKey.Destroy()
+		return nil, nil, -1
+	}
+	return newCf, newKey, 0
+}
+
+// rekeySwitch moves the old ciphertext entries out of the way and commits
+// the new config file.
+func rekeySwitch(rootCipherDir string) error {
+	oldDir := filepath.Join(rootCipherDir, rekeyOldDirName)
+	stagingConf := filepath.Join(rootCipherDir, rekeyDirName, configfile.ConfDefaultName)
+	if err := os.Mkdir(oldDir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	entries, err := os.ReadDir(rootCipherDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if isReservedRootName(e.Name()) {
+			continue
+		}
+		if err = os.Rename(filepath.Join(rootCipherDir, e.Name()), filepath.Join(oldDir, e.Name())); err != nil {
+			return err
+		}
+	}
+	js, err := os.ReadFile(stagingConf)
+	if err != nil {
+		return err
+	}
+	cf, err := configfile.Parse(js, filepath.Join(rootCipherDir, configfile.ConfDefaultName))
+	if err != nil {
+		return err
+	}
+	// Replaces the config file and its backup
+	if err = cf.WriteFile(); err != nil {
+		return err
+	}
+	return os.Remove(stagingConf)
+}
+
+// rekeyFinish moves the new ciphertext entries to the root and deletes the
+// old ones and the index, which is encrypted with the old key.
+func rekeyFinish(rootCipherDir string) error {
+	stagingDir := filepath.Join(rootCipherDir, rekeyDirName)
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		if isReservedRootName(e.Name()) {
+			continue
+		}
+		if err = os.Rename(filepath.Join(stagingDir, e.Name()), filepath.Join(rootCipherDir, e.Name())); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{indexFileName, indexFileName + ".tmp"} {
+		if err = os.Remove(filepath.Join(rootCipherDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// Staging directory first: as long as the old directory exists, we know
+	// that we are finishing
+	if err = removeAllForce(stagingDir); err != nil {
+		return err
+	}
+	return removeAllForce(filepath.Join(rootCipherDir, rekeyOldDirName))
+}
+
+// removeAllForce deletes the ciphertext tree "dir", including read-only
+// directories.
+func removeAllForce(dir string) error {
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(p, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
+
+// gcf_rekey replaces the master key of the volume in "rootCipherDir" by a new
+// random one: all file names, file headers and content blocks are
+// re-encrypted, and the directories get new DirIVs. Use it when the master key
+// or a cached scrypt hash may have been exposed, which changing the password
+// does not help against.
+//
+// The volume must not be opened during the re-key, and it can't be opened
+// until the re-key is complete: gcf_init returns -5 then, and the functions
+// changing the config file fail. "password" is the current
+// password, it also protects the new master key. Hashes can't be used, since
+// they may be the exposed secret. The scrypt cost is set to "logN", or kept
+// if 0. If "returnedScryptHashBuff" is not empty, the new scrypt hash is
+// copied to it like with gcf_init. Recovery recipients are kept, master key
+// shares and cached hashes become invalid. The name index is deleted.
+//
+// The volume is copied inside the ciphertext directory, which needs enough
+// free space for a second copy. If the re-key is interrupted, by a crash or by
+// "progressCallback", calling gcf_rekey again with the same password resumes
+// it. "progressCallback" may be NULL or point to a function like for
+// gcf_copy_file, called with -1 as volume ID and the number of plaintext
+// bytes re-encrypted. Hard links are kept.
+//
+// Returns 0 on success, -1 on I/O errors or if the volume is opened, -2 if the
+// password is wrong, -4 if the config file has been tampered with and -6 if
+// the re-key has been aborted by "progressCallback" (-5 is what gcf_init
+// returns until the re-key is complete).
+//
+//export gcf_rekey
+func gcf_rekey(rootCipherDir string, password []byte, logN int, returnedScryptHashBuff []byte, progressCallback unsafe.Pointer) int {
+	defer wipe(password)
+	if logN != 0 && !configfile.ValidScryptLogN(logN) {
+		return -1
+	}
+	lock, err := lockRoot(rootCipherDir, syscall.LOCK_EX)
+	if err != nil || volumeIsOpen(rootCipherDir) {
+		return -1
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	progress := hostProgress(progressCallback, -1)
+	stagingConf := filepath.Join(rootCipherDir, rekeyDirName, configfile.ConfDefaultName)
+	_, errOld := os.Lstat(filepath.Join(rootCipherDir, rekeyOldDirName))
+	_, errConf := os.Lstat(stagingConf)
+	switch {
+	case errOld == nil && errConf != nil:
+		// Finishing, the new config is in the root
+		_, masterkey, errCode := unlockMasterkey(rootCipherDir, password, nil, returnedScryptHashBuff)
+		if errCode != 0 {
+			return errCode
+		}
+		masterkey.Destroy()
+	case errOld == nil:
+		// Switching, the root config may be the old or the new one
+		cf, err := configfile.Load(stagingConf)
+		if err != nil {
+			return -1
+		}
+		masterkey, err := cf.GetMasterkey(password, nil, returnedScryptHashBuff)
+		if err != nil {
+			return unlockErrCode(err)
+		}
+		masterkey.Destroy()
+		if rekeySwitch(rootCipherDir) != nil {
+			return -1
+		}
+	default:
+		if errCode := rekeyCopy(rootCipherDir, password, logN, returnedScryptHashBuff, progress); errCode != 0 {
+			return errCode
+		}
+		if rekeySwitch(rootCipherDir) != nil {
+			return -1
+		}
+	}
+	if rekeyFinish(rootCipherDir) != nil {
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"libgocryptfs/v2/internal/syscallcompat"
+)
+
+// cipherStat returns the stat of the ciphertext of "path".
+func cipherStat(t *testing.T, volumeID int, path string) *syscall.Stat_t {
+	t.Helper()
+	dirfd, cName, err := getVolume(t, volumeID).prepareAtSyscall(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// fillRekeyVolume creates a tree with a sparse file, long names, a hard link
+// and an index in the volume in "dir", and returns the content of the sparse
+// file.
+func fillRekeyVolume(t *testing.T, dir string) []byte {
+	t.Helper()
+	volumeID := gcf_init(dir, []byte(testPassword), nil, nil)
+	if volumeID < 0 {
+		t.Fatalf("gcf_init returned %d", volumeID)
+	}
+	defer gcf_close_volume(volumeID, 1000, false)
+	gcf_mkdir(volumeID, "/d", 0750)
+	gcf_mkdir(volumeID, "/d/sub", 0700)
+	data := make([]byte, 1000010)
+	copy(data, testData(300000))
+	copy(data[1000000:], testData(10))
+	handleID := gcf_open_write_mode(volumeID, "/d/f", 0640)
+	for off := 0; off < 300000; off += 100000 {
+		gcf_write_file(volumeID, handleID, uint64(off), data[off:off+100000])
+	}
+	gcf_truncate(volumeID, "/d/f", 1000000)
+	gcf_write_file(volumeID, handleID, 1000000, data[1000000:])
+	gcf_close_file(volumeID, handleID)
+	for i := 0; i < 5; i++ {
+		writeTestFile(t, volumeID, "/d/sub/"+strings.Repeat(string(rune('a'+i)), 200), []byte("hello"))
+	}
+	writeTestFile(t, volumeID, "/top", testData(100000))
+	// gocryptfs file contents don't depend on their names, so a hard link
+	// made behind our back can be read through both names
+	volume := getVolume(t, volumeID)
+	dirfd, cName, _ := volume.prepareAtSyscall("/top")
+	dirfd2, cName2, _ := volume.prepareAtSyscall("/d/link")
+	err := unix.Linkat(dirfd, cName, dirfd2, cName2, 0)
+	syscall.Close(dirfd)
+	syscall.Close(dirfd2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcf_index_rebuild(volumeID, nil)
+	return data
+}
+
+// checkRekeyVolume checks the content written by fillRekeyVolume.
+func checkRekeyVolume(t *testing.T, dir string, data []byte) {
+	t.Helper()
+	volumeID := openTestVolume(t, dir)
+	defer gcf_close_volume(volumeID, 1000, false)
+	if mode, size, _, _ := gcf_get_attrs(volumeID, "/d/f"); size != uint64(len(data)) || mode&0777 != 0640 {
+		t.Fatalf("/d/f: mode %o, size %d", mode, size)
+	}
+	if mode, _, _, _ := gcf_get_attrs(volumeID, "/d"); mode&0777 != 0750 {
+		t.Errorf("/d: mode %o", mode)
+	}
+	if !bytes.Equal(readAll(t, volumeID, "/d/f", len(data)), data) {
+		t.Fatal("/d/f differs")
+	}
+	for i := 0; i < 5; i++ {
+		if string(readTestFile(t, volumeID, "/d/sub/"+strings.Repeat(string(rune('a'+i)), 200), 10)) != "hello" {
+			t.Fatal("long name file differs")
+		}
+	}
+	if !bytes.Equal(readAll(t, volumeID, "/d/link", 100000), testData(100000)) {
+		t.Fatal("hard link differs")
+	}
+	if cipherStat(t, volumeID, "/d/link").Ino != cipherStat(t, volumeID, "/top").Ino {
+		t.Error("hard link broken up")
+	}
+	// The index was encrypted with the old key
+	if _, n := gcf_index_search(volumeID, "", false, 0, 0, 0, 0, 0); n != -1 {
+		t.Error("index kept")
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), rekeyDirName) {
+			t.Errorf("%q left behind", e.Name())
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	dir := t.TempDir()
+	oldHash := make([]byte, 32)
+	if !gcf_create_volume(dir, []byte(testPassword), false, 0, 10, "test", oldHash) {
+		t.Fatal("gcf_create_volume failed")
+	}
+	data := fillRekeyVolume(t, dir)
+	privateKey, publicKey := make([]byte, 32), make([]byte, 32)
+	gcf_generate_recovery_key(privateKey, publicKey)
+	gcf_add_recovery_recipient(dir, []byte(testPassword), nil, publicKey, "test")
+
+	volumeID := gcf_init(dir, []byte(testPassword), nil, nil)
+	if code := gcf_rekey(dir, []byte(testPassword), 0, nil, nil); code != -1 {
+		t.Errorf("re-keyed an open volume: %d", code)
+	}
+	gcf_close_volume(volumeID, 1000, false)
+	// Opened by another process
+	lock, _ := lockRoot(dir, syscall.LOCK_SH)
+	if code := gcf_rekey(dir, []byte(testPassword), 0, nil, nil); code != -1 {
+		t.Errorf("re-keyed a locked volume: %d", code)
+	}
+	lock.Close()
+	if code := gcf_rekey(dir, []byte("wrong"), 0, nil, nil); code != -2 {
+		t.Errorf("wrong password: %d", code)
+	}
+	if code := gcf_rekey(dir, []byte(testPassword), 11, nil, nil); code != 0 {
+		t.Fatalf("gcf_rekey returned %d", code)
+	}
+	checkRekeyVolume(t, dir, data)
+
+	if code := gcf_init(dir, nil, oldHash, nil); code != -3 {
+		t.Errorf("old hash: gcf_init returned %d", code)
+	}
+	volumeID = gcf_init_with_recovery_key(dir, privateKey)
+	if volumeID < 0 {
+		t.Fatalf("gcf_init_with_recovery_key returned %d", volumeID)
+	}
+	gcf_close_volume(volumeID, 1000, false)
+}
+
+// An interrupted re-key resumes where it stopped.
+func TestRekeyResume(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// interrupt stops the re-key in the middle of a phase
+		interrupt func(t *testing.T, dir string)
+	}{
+		{"copy", func(t *testing.T, dir string) {
+			calls := 0
+			code := rekeyCopy(dir, []byte(testPassword), 0, nil, func(done, total uint64) bool {
+				calls++
+				return calls < 4
+			})
+			if code != -6 {
+				t.Fatalf("aborted copy: %d", code)
+			}
+			// Crashed in the middle of a file
+			os.WriteFile(filepath.Join(dir, rekeyDirName, rekeyPartialName), []byte("junk"), 0600)
+		}},
+		{"switch", func(t *testing.T, dir string) {
+			if code := rekeyCopy(dir, []byte(testPassword), 0, nil, func(done, total uint64) bool { return true }); code != 0 {
+				t.Fatalf("rekeyCopy returned %d", code)
+			}
+			// Crashed after moving the first entry out of the way
+			os.Mkdir(filepath.Join(dir, rekeyOldDirName), 0700)
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				if !isReservedRootName(e.Name()) {
+					os.Rename(filepath.Join(dir, e.Name()), filepath.Join(dir, rekeyOldDirName, e.Name()))
+					break
+				}
+			}
+		}},
+		{"committed", func(t *testing.T, dir string) {
+			rekeyCopy(dir, []byte(testPassword), 0, nil, func(done, total uint64) bool { return true })
+			if err := rekeySwitch(dir); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"finish", func(t *testing.T, dir string) {
+			rekeyCopy(dir, []byte(testPassword), 0, nil, func(done, total uint64) bool { return true })
+			rekeySwitch(dir)
+			// Crashed after moving the first new entry to the root
+			entries, _ := os.ReadDir(filepath.Join(dir, rekeyDirName))
+			for _, e := range entries {
+				if !isReservedRootName(e.Name()) {
+					os.Rename(filepath.Join(dir, rekeyDirName, e.Name()), filepath.Join(dir, e.Name()))
+					break
+				}
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := createTestVolume(t, false)
+			data := fillRekeyVolume(t, dir)
+			tc.interrupt(t, dir)
+
+			if code := gcf_init(dir, []byte(testPassword), nil, nil); code != -5 {
+				t.Errorf("gcf_init during the re-key returned %d", code)
+			}
+			if gcf_change_password(dir, []byte(testPassword), nil, []byte("new"), nil) {
+				t.Error("password changed during the re-key")
+			}
+			if code := gcf_rekey(dir, []byte(testPassword), 0, nil, nil); code != 0 {
+				t.Fatalf("resumed gcf_rekey returned %d", code)
+			}
+			checkRekeyVolume(t, dir, data)
+		})
+	}
+}
+
+func TestRekeyPlaintextNames(t *testing.T) {
+	dir := createTestVolume(t, true)
+	data := fillRekeyVolume(t, dir)
+	calls := 0
+	code := rekeyCopy(dir, []byte(testPassword), 0, nil, func(done, total uint64) bool {
+		calls++
+		return calls < 3
+	})
+	if code != -6 {
+		t.Fatalf("aborted copy: %d", code)
+	}
+	if code = gcf_rekey(dir, []byte(testPassword), 0, nil, nil); code != 0 {
+		t.Fatalf("gcf_rekey returned %d", code)
+	}
+	checkRekeyVolume(t, dir, data)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"C"
+	"errors"
+	"path/filepath"
+	"strings"
+	"unsafe"
+)
+
+// errStopWalk stops a walk without reporting an error.
+var errStopWalk = errors.New("walk stopped")
+
+// searchQuery selects the entries returned by gcf_search.
+type searchQuery struct {
+	// pattern is matched against the plaintext name (not the whole path).
+	// Empty matches everything.
+	pattern string
+	// glob: "pattern" is a filepath.Match pattern. Otherwise it is a
+	// case-insensitive substring.
+	glob bool
+	// Size limits in plaintext bytes, only regular files are returned if
+	// one is set. 0 means no limit.
+	minSize, maxSize uint64
+	// Modification time limits in seconds since the epoch. 0 means no limit.
+	minMtime, maxMtime uint64
+}
+
+func newSearchQuery(pattern string, glob bool, minSize, maxSize, minMtime, maxMtime uint64) (*searchQuery, error) {
+	if glob {
+		// Catch invalid patterns early, filepath.Match only reports them
+		// when it reaches the faulty part
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	} else {
+		pattern = strings.ToLower(pattern)
+	}
+	return &searchQuery{
+		pattern:  pattern,
+		glob:     glob,
+		minSize:  minSize,
+		maxSize:  maxSize,
+		minMtime: minMtime,
+		maxMtime: maxMtime,
+	}, nil
+}
+
+// matchName checks the name only, so that attributes are fetched for
+// candidates only.
+func (q *searchQuery) matchName(name string) bool {
+	if q.pattern == "" {
+		return true
+	}
+	if q.glob {
+		ok, _ := filepath.Match(q.pattern, name)
+		return ok
+	}
+	return strings.Contains(strings.ToLower(name), q.pattern)
+}
+
+// matchAttrs checks the size and mtime filters.
+func (q *searchQuery) matchAttrs(mode uint32, size, mtime uint64) bool {
+	if q.minSize > 0 || q.maxSize > 0 {
+		if !isRegular(mode) || size < q.minSize || (q.maxSize > 0 && size > q.maxSize) {
+			return false
+		}
+	}
+	if mtime < q.minMtime || (q.maxMtime > 0 && mtime > q.maxMtime) {
+		return false
+	}
+	return true
+}
+
+// search returns the plaintext paths below "dirPath" matching "q", at most
+// "limit" of them (no limit if 0).
+func (volume *Volume) search(dirPath string, q *searchQuery, limit int) ([]string, error) {
+	var results []string
+	err := volume.walkTree(dirPath, func(e *walkEntry) error {
+		if !q.matchName(e.name) {
+			return nil
+		}
+		size, mtime, err := volume.entryAttrs(e)
+		if err != nil || !q.matchAttrs(e.mode, size, mtime) {
+			return nil
+		}
+		results = append(results, e.path)
+		if limit > 0 && len(results) >= limit {
+			return errStopWalk
+		}
+		return nil
+	}, nil)
+	if err == errStopWalk {
+		err = nil
+	}
+	return results, err
+}
+
+// gcf_walk calls "callback" for every file, directory and symlink below
+// "dirPath", depth-first, directories before their content.
+//
+// "callback" must point to a function
+// "int callback(int volumeID, const char* path, unsigned int mode, unsigned long long size, unsigned long long mtime)".
+// "path" is the plaintext path, only valid during the call, "size" is the
+// plaintext size. Returning non-zero stops the walk.
+//
+// Returns false if "dirPath" can't be read. Subdirectories that can't be read
+// are skipped.
+//
+//export gcf_walk
+func gcf_walk(sessionID int, dirPath string, callback unsafe.Pointer) bool {
+	if callback == nil {
+		return false
+	}
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return false
+	}
+	defer volume.release()
+	err := volume.walkTree(dirPath, func(e *walkEntry) error {
+		size, mtime, err := volume.entryAttrs(e)
+		if err != nil {
+			// Deleted in the meantime
+			return errSkipDir
+		}
+		if !callWalkCallback(callback, sessionID, e.path, e.mode, size, mtime) {
+			return errStopWalk
+		}
+		return nil
+	}, nil)
+	return err == nil || err == errStopWalk
+}
+
+// gcf_search returns the plaintext paths below "dirPath" whose name matches
+// "pattern", as a NUL-separated list, and their number.
+//
+// "pattern" is a shell glob (like "*.jpg") if "glob" is set, otherwise a
+// case-insensitive substring. An empty pattern matches everything.
+// If "minSize" or "maxSize" (plaintext bytes) is non-zero, only regular files
+// within the limits are returned. "minMtime" and "maxMtime" (seconds since the
+// epoch) limit the modification time if non-zero. At most "limit" paths are
+// returned, all of them if "limit" is 0.
+//
+// Returns NULL and -1 on error.
+//
+//export gcf_search
+func gcf_search(sessionID int, dirPath string, pattern string, glob bool, minSize, maxSize, minMtime, maxMtime uint64, limit int) (*C.char, C.int) {
+	volume, ok := acquireVolume(sessionID)
+	if !ok {
+		return nil, -1
+	}
+	defer volume.release()
+	q, err := newSearchQuery(pattern, glob, minSize, maxSize, minMtime, maxMtime)
+	if err != nil {
+		return nil, -1
+	}
+	results, err := volume.search(dirPath, q, limit)
+	if err != nil {
+		return nil, -1
+	}
+	return pathList(results)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeSearchTree creates a small tree of named files, and returns the
+// ciphertext directory.
+func makeSearchTree(t *testing.T) (string, int) {
+	t.Helper()
+	dir, volumeID := newTestVolume(t)
+	gcf_mkdir(volumeID, "/Photos", 0700)
+	gcf_mkdir(volumeID, "/Photos/2024", 0700)
+	writeTestFile(t, volumeID, "/Photos/a.jpg", testData(100))
+	writeTestFile(t, volumeID, "/Photos/2024/B.JPG", testData(5000))
+	writeTestFile(t, volumeID, "/notes.txt", []byte("notes"))
+	// An old file
+	old := time.Unix(1000000000, 0)
+	os.Chtimes(filepath.Join(dir, cipherNameOf(t, volumeID, "notes.txt")), old, old)
+	return dir, volumeID
+}
+
+func TestSearch(t *testing.T) {
+	_, volumeID := makeSearchTree(t)
+	volume := getVolume(t, volumeID)
+	search := func(pattern string, glob bool, minSize, maxSize, minMtime, maxMtime uint64, limit int) []string {
+		t.Helper()
+		q, err := newSearchQuery(pattern, glob, minSize, maxSize, minMtime, maxMtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := volume.search("/", q, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+	for _, tc := range []struct {
+		got  []string
+		want []string
+	}{
+		// Globs are case-sensitive and match the name only
+		{search("*.jpg", true, 0, 0, 0, 0, 0), []string{"/Photos/a.jpg"}},
+		{search("Photos/*", true, 0, 0, 0, 0, 0), nil},
+		// Substrings are not
+		{search("JPG", false, 0, 0, 0, 0, 0), []string{"/Photos/2024/B.JPG", "/Photos/a.jpg"}},
+		// Size limits return regular files only
+		{search("", false, 100, 0, 0, 0, 0), []string{"/Photos/2024/B.JPG", "/Photos/a.jpg"}},
+		{search("", false, 0, 100, 0, 0, 0), []string{"/Photos/a.jpg", "/notes.txt"}},
+		{search("", false, 0, 0, 0, 1000000001, 0), []string{"/notes.txt"}},
+		{search("", false, 0, 0, 1000000001, 0, 0), []string{"/Photos", "/Photos/2024", "/Photos/2024/B.JPG", "/Photos/a.jpg"}},
+	} {
+		sort.Strings(tc.got)
+		if !reflect.DeepEqual(tc.got, tc.want) {
+			t.Errorf("got %v, want %v", tc.got, tc.want)
+		}
+	}
+	if len(search("", false, 0, 0, 0, 0, 2)) != 2 {
+		t.Error("limit ignored")
+	}
+
+	if _, n := gcf_search(volumeID, "/Photos", "jpg", false, 0, 0, 0, 0, 0); n != 2 {
+		t.Errorf("gcf_search found %d paths", n)
+	}
+	if _, n := gcf_search(volumeID, "/", "[", true, 0, 0, 0, 0, 0); n != -1 {
+		t.Error("invalid glob accepted")
+	}
+	if _, n := gcf_search(volumeID, "/missing", "", false, 0, 0, 0, 0, 0); n != -1 {
+		t.Error("missing directory searched")
+	}
+}
+
+// Directories are entered before their content and left after it, and
+// errSkipDir skips the content.
+func TestWalkTree(t *testing.T) {
+	dir, volumeID := makeSearchTree(t)
+	// Entries that can't be decrypted are not walked
+	os.WriteFile(filepath.Join(dir, "garbage"), nil, 0600)
+	volume := getVolume(t, volumeID)
+	var entered, left []string
+	err := volume.walkTree("/", func(e *walkEntry) error {
+		entered = append(entered, e.path)
+		return nil
+	}, func(e *walkEntry) error {
+		left = append(left, e.path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entered) != 5 {
+		t.Fatalf("entered %v", entered)
+	}
+	index := make(map[string]int)
+	for i, path := range entered {
+		index[path] = i
+	}
+	for _, path := range entered {
+		if parent := filepath.Dir(path); parent != "/" && index[parent] > index[path] {
+			t.Errorf("%q entered before %q", path, parent)
+		}
+	}
+	if strings.Join(left, ",") != "/Photos/2024,/Photos" {
+		t.Errorf("left %v", left)
+	}
+
+	entered = nil
+	err = volume.walkTree("/", func(e *walkEntry) error {
+		entered = append(entered, e.path)
+		if e.path == "/Photos" {
+			return errSkipDir
+		}
+		return nil
+	}, nil)
+	sort.Strings(entered)
+	if err != nil || strings.Join(entered, ",") != "/Photos,/notes.txt" {
+		t.Errorf("skipped walk: %v, %v", entered, err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"C"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"libgocryptfs/v2/internal/configfile"
+	"libgocryptfs/v2/internal/securemem"
+	"libgocryptfs/v2/internal/shamir"
+)
+
+// Master key shares are handed to the host as base32 strings in groups of 4
+// characters, which can be printed, read aloud or put in QR codes
+// (alphanumeric mode). They encode:
+//
+//	version (1 byte) | threshold (1 byte) | shamir share | checksum (4 bytes)
+//
+// The checksum catches typos in a single share.
+const (
+	shareVersion     = 1
+	shareChecksumLen = 4
+	shareGroupLen    = 4
+)
+
+var (
+	errInvalidShare = errors.New("invalid master key share")
+	// errMixedShares is returned for shares that differ in threshold or
+	// length, so they can't come from the same split.
+	errMixedShares = errors.New("master key shares from different splits")
+)
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func shareChecksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:shareChecksumLen]
+}
+
+// encodeShare converts a share returned by shamir.Split to its string form.
+func encodeShare(share []byte, threshold int) string {
+	data := append([]byte{shareVersion, byte(threshold)}, share...)
+	data = append(data, shareChecksum(data)...)
+	s := shareEncoding.EncodeToString(data)
+	wipe(data)
+	var groups []string
+	for i := 0; i < len(s); i += shareGroupLen {
+		groups = append(groups, s[i:min(i+shareGroupLen, len(s))])
+	}
+	return strings.Join(groups, "-")
+}
+
+// decodeShare parses a share string, ignoring case, spaces and dashes.
+func decodeShare(s string) (share []byte, threshold int, err error) {
+	s = strings.ToUpper(strings.NewReplacer("-", "", " ", "", "\n", "").Replace(s))
+	data, err := shareEncoding.DecodeString(s)
+	if err != nil || len(data) < 2+2+shareChecksumLen || data[0] != shareVersion {
+		return nil, 0, errInvalidShare
+	}
+	payload := data[:len(data)-shareChecksumLen]
+	if !bytes.Equal(shareChecksum(payload), data[len(payload):]) {
+		return nil, 0, errInvalidShare
+	}
+	return payload[2:], int(payload[1]), nil
+}
+
+// combineShares decodes the NUL-separated "shares" and reconstructs the
+// master key of "cf", checked against the config MAC.
+func combineShares(cf *configfile.ConfFile, shares string) (*securemem.Buffer, error) {
+	var decoded [][]byte
+	defer func() {
+		for _, s := range decoded {
+			wipe(s)
+		}
+	}()
+	threshold := 0
+	for _, s := range strings.Split(shares, "\x00") {
+		if s == "" {
+			continue
+		}
+		share, k, err := decodeShare(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(decoded) > 0 && (k != threshold || len(share) != len(decoded[0])) {
+			wipe(share)
+			return nil, errMixedShares
+		}
+		threshold = k
+		decoded = append(decoded, share)
+	}
+	if len(decoded) < threshold || !cf.HasMAC() {
+		// Without MAC, we could not tell if the result is right
+		return nil, errInvalidShare
+	}
+	key, err := shamir.Combine(decoded)
+	if err != nil {
+		return nil, err
+	}
+	masterkey := securemem.Move(key)
+	if cf.VerifyMAC(masterkey.Bytes()) != nil {
+		// Shares of another volume or of another split
+		masterkey.Destroy()
+		return nil, errInvalidShare
+	}
+	return masterkey, nil
+}
+
+// gcf_split_masterkey splits the master key of the volume in "rootCipherDir"
+// into "n" shares, any "k" of which open the volume with
+// gcf_init_with_shares or reset its password with
+// gcf_reset_password_with_shares. Unlocking needs "password", or
+// "givenScryptHash" if not empty.
+//
+// The config file must have a MAC, otherwise the shares could not be checked
+// when they are combined: see gcf_migrate_config_mac.
+//
+// Returns the same codes as gcf_verify_password (-1 also if n and k are
+// invalid: 2 <= k <= n <= 255, or if the config file has no MAC) and, on
+// success, the shares as a JSON array of strings. The host must free the
+// returned string.
+//
+//export gcf_split_masterkey
+func gcf_split_masterkey(rootCipherDir string, password, givenScryptHash []byte, n, k int) (int, *C.char) {
+	defer wipe(password)
+	cf, masterkey, errCode := unlockMasterkey(rootCipherDir, password, givenScryptHash, nil)
+	if errCode != 0 {
+		return errCode, nil
+	}
+	if !cf.HasMAC() {
+		masterkey.Destroy()
+		return -1, nil
+	}
+	shares, err := shamir.Split(masterkey.Bytes(), n, k)
+	masterkey.Destroy()
+	if err != nil {
+		return -1, nil
+	}
+	encoded := make([]string, len(shares))
+	for i := range shares {
+		encoded[i] = encodeShare(shares[i], k)
+		wipe(shares[i])
+	}
+	return 0, infoJSON(encoded)
+}
+
+// gcf_init_with_shares opens the volume in "rootCipherDir" with master key
+// shares returned by gcf_split_masterkey, separated by NUL characters, and
+// returns the volume ID.
+//
+// Returns -1 if the config file can't be loaded, -2 if a share is malformed,
+// if the shares come from different splits, if there are not enough shares or
+// if they don't belong to the volume, and
+// -5 like gcf_init during a re-key.
+//
+//export gcf_init_with_shares
+func gcf_init_with_shares(rootCipherDir string, shares string) int {
+	cf, err := configfile.Load(filepath.Join(rootCipherDir, configfile.ConfDefaultName))
+	if err != nil {
+		return -1
+	}
+	masterkey, err := combineShares(cf, shares)
+	if err != nil {
+		return -2
+	}
+	volumeID := registerNewVolume(rootCipherDir, masterkey.Bytes(), cf, &openOptions{})
+	masterkey.Destroy()
+	return volumeID
+}
+
+// gcf_reset_password_with_shares sets "newPassword" on the volume in
+// "rootCipherDir", unlocked with master key shares like gcf_init_with_shares.
+// "logN" is the scrypt cost of the new password, 0 keeps the current one. If
+// "returnedScryptHashBuff" is not empty, the new scrypt hash is copied to it
+// like with gcf_init.
+//
+// Returns 0 on success and the codes of gcf_init_with_shares.
+//
+//export gcf_reset_password_with_shares
+func gcf_reset_password_with_shares(rootCipherDir string, shares string, newPassword []byte, logN int, returnedScryptHashBuff []byte) int {
+	defer wipe(newPassword)
+	if logN != 0 && !configfile.ValidScryptLogN(logN) || rekeyPending(rootCipherDir) {
+		return -1
+	}
+	cf, err := configfile.Load(filepath.Join(rootCipherDir, configfile.ConfDefaultName))
+	if err != nil {
+		return -1
+	}
+	masterkey, err := combineShares(cf, shares)
+	if err != nil {
+		return -2
+	}
+	defer masterkey.Destroy()
+	if logN == 0 {
+		logN = cf.ScryptObject.LogN()
+	}
+	scryptHash := cf.EncryptKey(masterkey.Bytes(), newPassword, logN, len(returnedScryptHashBuff) > 0)
+	cf.SetMAC(masterkey.Bytes())
+	if scryptHash != nil {
+		cf.CopyScryptHash(returnedScryptHashBuff, scryptHash.Bytes())
+		scryptHash.Destroy()
+	}
+	if cf.WriteFile() != nil {
+		return -1
+	}
+	return 0
+}
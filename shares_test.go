@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"libgocryptfs/v2/internal/configfile"
+	"libgocryptfs/v2/internal/shamir"
+)
+
+// splitTestShares splits the master key of the volume in "dir" into "n"
+// encoded shares with threshold "k".
+func splitTestShares(t *testing.T, dir string, n, k int) []string {
+	t.Helper()
+	_, masterkey, errCode := unlockMasterkey(dir, []byte(testPassword), nil, nil)
+	if errCode != 0 {
+		t.Fatalf("unlockMasterkey returned %d", errCode)
+	}
+	defer masterkey.Destroy()
+	raw, err := shamir.Split(masterkey.Bytes(), n, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares := make([]string, len(raw))
+	for i := range raw {
+		shares[i] = encodeShare(raw[i], k)
+	}
+	return shares
+}
+
+func TestShares(t *testing.T) {
+	dir := createTestVolume(t, false)
+	shares := splitTestShares(t, dir, 5, 3)
+
+	if code := gcf_init_with_shares(dir, shares[0]+"\x00"+shares[3]); code != -2 {
+		t.Errorf("not enough shares: %d", code)
+	}
+	// Shares are case-insensitive and can be given in any order
+	three := strings.ToLower(shares[4]) + "\x00" + shares[1] + "\x00" + shares[2]
+	volumeID := gcf_init_with_shares(dir, three)
+	if volumeID < 0 {
+		t.Fatalf("gcf_init_with_shares returned %d", volumeID)
+	}
+	gcf_close_volume(volumeID, 1000, false)
+
+	typo := []byte(shares[0])
+	typo[0] ^= 'A' ^ 'B'
+	if code := gcf_init_with_shares(dir, string(typo)+"\x00"+shares[1]+"\x00"+shares[2]); code != -2 {
+		t.Errorf("share with a typo: %d", code)
+	}
+	// Shares of the same volume with another threshold
+	other := splitTestShares(t, dir, 3, 2)
+	cf, err := configfile.Load(filepath.Join(dir, configfile.ConfDefaultName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = combineShares(cf, shares[0]+"\x00"+shares[1]+"\x00"+other[2]); err != errMixedShares {
+		t.Errorf("mixed thresholds: got %v", err)
+	}
+	if code := gcf_init_with_shares(dir, other[0]+"\x00"+shares[1]+"\x00"+shares[2]); code != -2 {
+		t.Errorf("mixed thresholds: %d", code)
+	}
+
+	if code := gcf_reset_password_with_shares(dir, three, []byte("reset"), 10, nil); code != 0 {
+		t.Fatalf("gcf_reset_password_with_shares returned %d", code)
+	}
+	if code := gcf_verify_password(dir, []byte("reset"), nil, nil); code != 0 {
+		t.Errorf("new password: %d", code)
+	}
+	if code := gcf_verify_password(dir, []byte(testPassword), nil, nil); code != -2 {
+		t.Errorf("old password: %d", code)
+	}
+}
+
+// Shares of volumes without config MAC could not be checked.
+func TestSplitWithoutMAC(t *testing.T) {
+	dir := createTestVolume(t, false)
+	if code, _ := gcf_split_masterkey(dir, []byte("wrong"), nil, 5, 3); code != -2 {
+		t.Errorf("wrong password: %d", code)
+	}
+	if code, _ := gcf_split_masterkey(dir, []byte(testPassword), nil, 2, 3); code != -1 {
+		t.Errorf("k > n: %d", code)
+	}
+
+	// Write the config like gocryptfs does
+	cf, err := configfile.Load(filepath.Join(dir, configfile.ConfDefaultName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, err := cf.GetMasterkey([]byte(testPassword), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags []string
+	for _, f := range cf.FeatureFlags {
+		if f != "ConfigMAC" {
+			flags = append(flags, f)
+		}
+	}
+	cf.FeatureFlags = flags
+	cf.EncryptKey(masterkey.Bytes(), []byte(testPassword), 10, false)
+	masterkey.Destroy()
+	cf.ConfigMAC = nil
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, shares := gcf_split_masterkey(dir, []byte(testPassword), nil, 5, 3); code != -1 || shares != nil {
+		t.Errorf("gcf_split_masterkey returned %d", code)
+	}
+}
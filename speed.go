@@ -0,0 +1,26 @@
+package main
+
+import (
+	"C"
+	"time"
+
+	"libgocryptfs/v2/internal/speed"
+)
+
+// gcf_speed measures the encryption speed of every available content
+// encryption backend on this device, like "gocryptfs -speed", spending
+// "durationMs" milliseconds on each. Returns a JSON array of objects with the
+// fields Backend (like "AES-GCM-256-OpenSSL"), MBPerSec and Preferred (the
+// backend used by default for its algorithm). The host must free the returned
+// string.
+//
+// A backend name can be passed to gcf_init_with_options to override the
+// default choice.
+//
+//export gcf_speed
+func gcf_speed(durationMs int) *C.char {
+	if durationMs <= 0 {
+		return nil
+	}
+	return infoJSON(speed.Run(availableBackends(), time.Duration(durationMs)*time.Millisecond))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"C"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"libgocryptfs/v2/internal/configfile"
+)
+
+// Phases of an unlock reported to the progress callback of gcf_init_async
+const (
+	// The config file has been loaded, the key derivation starts
+	unlockPhaseKDFStarted = 0
+	// The key derivation finished and the master key has been decrypted
+	unlockPhaseKDFDone = 1
+	// The config file has been verified against its MAC, the volume is
+	// being opened
+	unlockPhaseConfigVerified = 2
+)
+
+// unlockRequest is an unlock started by gcf_init_async.
+type unlockRequest struct {
+	callback unsafe.Pointer
+}
+
+var (
+	// unlockLock protects pendingUnlocks and nextUnlockID
+	unlockLock     sync.Mutex
+	pendingUnlocks = make(map[int]*unlockRequest)
+	nextUnlockID   = 1
+)
+
+// unlockPending returns true if the request "requestID" has been neither
+// finished nor cancelled.
+func unlockPending(requestID int) bool {
+	unlockLock.Lock()
+	defer unlockLock.Unlock()
+	_, ok := pendingUnlocks[requestID]
+	return ok
+}
+
+// takeUnlock removes the request "requestID" from pendingUnlocks. Returns
+// nil if it has already been finished or cancelled.
+func takeUnlock(requestID int) *unlockRequest {
+	unlockLock.Lock()
+	defer unlockLock.Unlock()
+	req, ok := pendingUnlocks[requestID]
+	if !ok {
+		return nil
+	}
+	delete(pendingUnlocks, requestID)
+	return req
+}
+
+// gcf_init_async opens a volume like gcf_init_with_options, but derives the
+// key in the background so that the calling thread is not blocked by scrypt.
+// The passwords and hashes are copied and wiped before returning.
+//
+// "callback" must point to a function "void callback(int requestID, int
+// result, const unsigned char* scryptHash, int scryptHashLen)", called once
+// from a background thread when the volume is opened, with the volume ID as
+// "result", or when opening failed, with a gcf_init error code. If
+// "returnScryptHash" is set, the enveloped scrypt hash (see gcf_init) is
+// passed to successful callbacks.
+// It is wiped after the callback returns, the host must copy it.
+//
+// "progressCallback", if not NULL, must point to a function "void
+// progressCallback(int requestID, int phase)", called from the same background
+// thread before "callback" as the unlock goes through its phases: 0 when the
+// key derivation starts, 1 when it finished, 2 when the config file has been
+// verified. Phases after a failure are not reported. After a cancellation,
+// only a phase whose report was already under way can still reach the host.
+//
+// Returns the request ID, to pass to gcf_cancel_unlock, or -1 if "callback"
+// is NULL or a badname pattern is malformed.
+//
+//export gcf_init_async
+func gcf_init_async(rootCipherDir string, password, givenScryptHash []byte, returnScryptHash bool, badnamePatterns string, backend string, callback, progressCallback unsafe.Pointer) int {
+	// The arguments point to host memory, which is only valid during this call
+	pw := append([]byte(nil), password...)
+	hash := append([]byte(nil), givenScryptHash...)
+	wipe(password)
+	wipe(givenScryptHash)
+	badname, err := parseBadnamePatterns(badnamePatterns)
+	if callback == nil || err != nil {
+		wipe(pw)
+		wipe(hash)
+		return -1
+	}
+	opts := &openOptions{
+		badname: badname,
+		backend: strings.Clone(backend),
+	}
+	rootCipherDir = strings.Clone(rootCipherDir)
+
+	unlockLock.Lock()
+	requestID := nextUnlockID
+	nextUnlockID++
+	pendingUnlocks[requestID] = &unlockRequest{callback: callback}
+	unlockLock.Unlock()
+
+	go func() {
+		var returnedScryptHash []byte
+		if returnScryptHash {
+			returnedScryptHash = make([]byte, configfile.ScryptHashEnvelopeLen)
+		}
+		defer wipe(returnedScryptHash)
+		cf, masterkey, result := unlockMasterkeyNotify(rootCipherDir, pw, hash, returnedScryptHash, func(phase int) {
+			if unlockPending(requestID) {
+				callUnlockProgressCallback(progressCallback, requestID, phase)
+			}
+		})
+		wipe(pw)
+		wipe(hash)
+		req := takeUnlock(requestID)
+		if req == nil {
+			// Cancelled
+			if masterkey != nil {
+				masterkey.Destroy()
+			}
+			return
+		}
+		if result == 0 {
+			result = openUnlockedVolume(rootCipherDir, masterkey.Bytes(), cf, opts)
+			masterkey.Destroy()
+		}
+		if result < 0 {
+			returnedScryptHash = nil
+		}
+		callUnlockCallback(req.callback, requestID, result, returnedScryptHash)
+	}()
+	return requestID
+}
+
+// gcf_cancel_unlock cancels an unlock started by gcf_init_async. The key
+// derivation can't be interrupted and keeps running in the background, but
+// its result is discarded and the callback is not called.
+//
+// Returns false if the unlock already finished, in which case the callback
+// has been or is being called, and the host has to close the volume itself.
+//
+//export gcf_cancel_unlock
+func gcf_cancel_unlock(requestID int) bool {
+	return takeUnlock(requestID) != nil
+}
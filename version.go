@@ -0,0 +1,139 @@
+package main
+
+import (
+	"C"
+	"runtime"
+
+	"libgocryptfs/v2/internal/configfile"
+	"libgocryptfs/v2/internal/cryptocore"
+	"libgocryptfs/v2/internal/stupidgcm"
+)
+
+// GitVersion is the library version, set by build.sh with
+// -ldflags "-X main.GitVersion=...".
+var GitVersion = "[GitVersion not set - please compile using ./build.sh]"
+
+// ABIVersion is incremented every time exported functions are added or
+// their signature changes. Hosts compare it with the version they were
+// written for before calling newer functions.
+//
+// 1: gcf_version, gcf_abi_version, gcf_capabilities
+// 2: gcf_speed, "backend" parameter added to gcf_init_with_options
+// 3: gcf_calibrate_kdf, gcf_change_password_with_cost
+// 4: gcf_verify_password
+// 5: gcf_init_async, gcf_cancel_unlock
+// 6: scrypt hash buffers of exactly ScryptHashLen bytes are enveloped,
+// gcf_init returns -3 for stale hashes
+// 7: gcf_check_config, gcf_restore_config, gcf_export_config,
+// gcf_import_config
+// 8: config file MAC, gcf_init returns -4 if tampered,
+// gcf_migrate_config_mac
+// 9: gcf_generate_recovery_key, gcf_add_recovery_recipient,
+// gcf_remove_recovery_recipient, gcf_list_recovery_recipients,
+// gcf_init_with_recovery_key
+// 10: gcf_split_masterkey, gcf_init_with_shares,
+// gcf_reset_password_with_shares
+// 11: gcf_rekey, gcf_init returns -5 during a re-key
+const ABIVersion = 11
+
+// libFeatures lists the optional groups of exported functions, so hosts can
+// check for a feature instead of comparing ABI versions.
+var libFeatures = []string{
+	"close_volume",     // gcf_close_volume
+	"idle_lock",        // gcf_set_idle_timeout, gcf_lock
+	"badname",          // gcf_init_with_options
+	"invalid_entries",  // gcf_list_dir_with_invalid, gcf_remove_invalid_entry, gcf_quarantine_invalid_entry
+	"path_translation", // gcf_encrypt_path, gcf_decrypt_path
+	"ctlsock",          // gcf_start_ctlsock, gcf_stop_ctlsock
+	"copy",             // gcf_copy_file
+	"rename_flags",     // gcf_rename_flags
+	"recursive",        // gcf_remove_recursive, gcf_move
+	"search",           // gcf_walk, gcf_search
+	"index",            // gcf_index_rebuild, gcf_index_delete, gcf_index_search, gcf_index_recent
+	"volume_info",      // gcf_volume_info, gcf_opened_volume_info
+	"capabilities",     // gcf_version, gcf_abi_version, gcf_capabilities
+	"speed",            // gcf_speed, backend override in gcf_init_with_options
+	"kdf_calibration",  // gcf_calibrate_kdf, gcf_change_password_with_cost
+	"verify_password",  // gcf_verify_password
+	"async_unlock",     // gcf_init_async, gcf_cancel_unlock
+	"hash_envelope",    // enveloped scrypt hashes, gcf_init returns -3 if stale
+	"config_backup",    // gcf_check_config, gcf_restore_config, gcf_export_config, gcf_import_config
+	"config_mac",       // authenticated config file, gcf_migrate_config_mac, gcf_init returns -4 if tampered
+	"recovery_key",     // gcf_generate_recovery_key, gcf_add_recovery_recipient, gcf_remove_recovery_recipient, gcf_list_recovery_recipients, gcf_init_with_recovery_key
+	"shares",           // gcf_split_masterkey, gcf_init_with_shares, gcf_reset_password_with_shares
+	"rekey",            // gcf_rekey
+}
+
+// availableBackends returns the content encryption backends compiled into
+// the library.
+func availableBackends() []cryptocore.AEADTypeEnum {
+	backends := []cryptocore.AEADTypeEnum{
+		cryptocore.BackendGoGCM,
+		cryptocore.BackendAESSIV,
+		cryptocore.BackendXChaCha20Poly1305,
+	}
+	if !stupidgcm.BuiltWithoutOpenssl {
+		backends = append(backends, cryptocore.BackendOpenSSL, cryptocore.BackendXChaCha20Poly1305OpenSSL)
+	}
+	return backends
+}
+
+// capabilities is returned as JSON by gcf_capabilities.
+type capabilities struct {
+	Version    string
+	ABIVersion int
+	GoVersion  string
+	// FeatureFlags are the config file feature flags volumes may use
+	FeatureFlags []string
+	// Backends are the available content encryption implementations, like
+	// "AES-GCM-256-OpenSSL"
+	Backends []string
+	OpenSSL  bool
+	// CPUHasAES tells if the CPU has hardware AES acceleration
+	CPUHasAES bool
+	// Features are the optional groups of exported functions
+	Features []string
+	// ScryptHashLen is the size of the buffers receiving enveloped scrypt
+	// hashes, see gcf_init
+	ScryptHashLen int
+}
+
+// gcf_version returns the library version. The host must free the returned
+// string.
+//
+//export gcf_version
+func gcf_version() *C.char {
+	return C.CString(GitVersion)
+}
+
+// gcf_abi_version returns ABIVersion. It is incremented every time exported
+// functions are added or changed.
+//
+//export gcf_abi_version
+func gcf_abi_version() int {
+	return ABIVersion
+}
+
+// gcf_capabilities returns a JSON object describing the library: version,
+// ABI version, supported config file feature flags, available crypto
+// backends, whether OpenSSL was compiled in and the CPU has AES acceleration,
+// and the list of optional features. The host must free the returned string.
+//
+//export gcf_capabilities
+func gcf_capabilities() *C.char {
+	var backends []string
+	for _, b := range availableBackends() {
+		backends = append(backends, b.String())
+	}
+	return infoJSON(&capabilities{
+		Version:       GitVersion,
+		ABIVersion:    ABIVersion,
+		GoVersion:     runtime.Version(),
+		FeatureFlags:  configfile.KnownFeatureFlags(),
+		Backends:      backends,
+		OpenSSL:       !stupidgcm.BuiltWithoutOpenssl,
+		CPUHasAES:     stupidgcm.CpuHasAES(),
+		Features:      libFeatures,
+		ScryptHashLen: configfile.ScryptHashEnvelopeLen,
+	})
+}
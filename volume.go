@@ -5,16 +5,23 @@ package main
 
 import (
 	"C"
+	"errors"
+	"fmt"
 	"os"
 	"sync"
 	"syscall"
 	"path/filepath"
 	"runtime/debug"
+	"strings"
+	"time"
+
 
 	"libgocryptfs/v2/internal/configfile"
 	"libgocryptfs/v2/internal/contentenc"
 	"libgocryptfs/v2/internal/cryptocore"
+	"libgocryptfs/v2/internal/ctlsocksrv"
 	"libgocryptfs/v2/internal/nametransform"
+	"libgocryptfs/v2/internal/securemem"
 	"libgocryptfs/v2/internal/stupidgcm"
 	"libgocryptfs/v2/internal/syscallcompat"
 )
@@ -37,6 +44,13 @@ type Volume struct {
 	volumeID       int
 	rootCipherDir  string
 	plainTextNames bool
+	// conf is the config file the volume was opened with. It holds no
+	// secrets, the master key in it is encrypted.
+	conf           *configfile.ConfFile
+	// cryptoBackend is the AEAD implementation selected for the content
+	cryptoBackend  cryptocore.AEADTypeEnum
+	// badname holds the patterns passed with gcf_init_with_options
+	badname        []string
 	// dirIVLock: Lock()ed if any "gocryptfs.diriv" file is modified
 	// Readers must RLock() it to prevent them from seeing intermediate
 	// states
@@ -47,10 +61,52 @@ type Volume struct {
 	dirCache       dirCache
 	handlesLock    sync.RWMutex
 	fileHandles    map[int]*File
+	// ops counts the API calls running on this volume so that closing
+	// waits for them.
+	ops            opCount
+	// idleLock locks the volume when it is not used for too long
+	idleLock       idleLock
+	// ctlSock is the control socket server started by gcf_start_ctlsock
+	ctlSockLock    sync.Mutex
+	ctlSock        *ctlsocksrv.Server
+	// index is the optional name index, see index.go
+	index          nameIndex
+	// rootLock holds a shared lock on the ciphertext directory while the
+	// volume is registered, see lockRoot. nil if not locked.
+	rootLock       *os.File
 }
 
 var OpenedVolumes sync.Map
 
+// openOptions holds the optional settings a host can pass when opening a
+// volume.
+type openOptions struct {
+	// badname holds glob patterns matching ciphertext names that should be
+	// shown with nametransform.BadnameSuffix instead of being hidden when
+	// they can't be decrypted (like gocryptfs -badname).
+	badname []string
+	// backend is the name of the content encryption backend to use, like
+	// "AES-GCM-256-Go". Empty selects the fastest one with fixed heuristics.
+	backend string
+}
+
+// parseBadnamePatterns splits the NUL-separated list of glob patterns passed
+// by the host and validates them.
+func parseBadnamePatterns(patterns string) ([]string, error) {
+	var badname []string
+	for _, pattern := range strings.Split(patterns, "\x00") {
+		if pattern == "" {
+			continue
+		}
+		// Catch invalid patterns early, nametransform silently ignores them
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+		badname = append(badname, pattern)
+	}
+	return badname, nil
+}
+
 func wipe(d []byte) {
 	for i := range d {
 		d[i] = 0
@@ -62,29 +118,210 @@ func errToBool(err error) bool {
 	return err == nil
 }
 
-func registerNewVolume(rootCipherDir string, masterkey []byte, cf *configfile.ConfFile) int {
+// errToErrno converts an error to an errno value, 0 if "err" is nil and EIO
+// if it does not wrap a syscall.Errno.
+func errToErrno(err error) int {
+	if err == nil {
+		return 0
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return int(errno)
+	}
+	return int(syscall.EIO)
+}
+
+// acquireVolume looks up an opened volume and registers a new in-flight
+// operation on it. If it returns true, the caller must call release() when
+// done with the volume.
+func acquireVolume(volumeID int) (*Volume, bool) {
+	value, ok := OpenedVolumes.Load(volumeID)
+	if !ok {
+		return nil, false
+	}
+	volume := value.(*Volume)
+	if !volume.ops.begin() {
+		// The volume is being closed
+		return nil, false
+	}
+	volume.touch()
+	return volume, true
+}
+
+// release ends an operation started with acquireVolume.
+func (volume *Volume) release() {
+	volume.touch()
+	volume.ops.end()
+}
+
+// closeAllFiles flushes and closes every file handle the host did not close
+// and returns their IDs. If "wait" is false, the handles a read or write is
+// still using are not waited for but returned in "busy". The caller must
+// close them with closeLockedFile once the volume is idle.
+func (volume *Volume) closeAllFiles(wait bool) (fileHandles []int, busy []*File) {
+	volume.handlesLock.RLock()
+	fileHandles = make([]int, 0, len(volume.fileHandles))
+	for handleID := range volume.fileHandles {
+		fileHandles = append(fileHandles, handleID)
+	}
+	volume.handlesLock.RUnlock()
+	for _, handleID := range fileHandles {
+		if wait {
+			volume.closeFile(handleID, true)
+			continue
+		}
+		f := volume.unregisterFile(handleID)
+		if f == nil {
+			continue
+		}
+		if f.fdLock.TryLock() {
+			volume.closeLockedFile(f, true)
+		} else {
+			busy = append(busy, f)
+		}
+	}
+	return fileHandles, busy
+}
+
+// wipe drops the keys and the cached directory fds. The volume can't be
+// used anymore afterwards.
+func (volume *Volume) wipe() {
+	volume.cryptoCore.Wipe()
+	volume.dirCache.Clear()
+	if volume.rootLock != nil {
+		volume.rootLock.Close()
+		volume.rootLock = nil
+	}
+}
+
+// close unregisters the volume once the in-flight operations returned, closes
+// all file handles and wipes the keys. See gcf_close_volume.
+func (volume *Volume) close(timeout time.Duration, force bool) ([]int, bool) {
+	if timeout < 0 && inHostCall(volume.volumeID) {
+		// Called from a progress or walk callback: waiting for the
+		// operation that called the host would never return.
+		return nil, false
+	}
+	if !volume.ops.startClosing() {
+		// Someone else is already closing this volume
+		return nil, false
+	}
+	idle := volume.ops.wait(timeout)
+	if !idle && !force {
+		volume.ops.cancelClosing()
+		return nil, false
+	}
+	volume.stopIdleTimer()
+	volume.stopCtlSock()
+	OpenedVolumes.Delete(volume.volumeID)
+	fileHandles, busy := volume.closeAllFiles(idle)
+	volume.flushIndex()
+	if idle {
+		volume.wipe()
+	} else {
+		// Operations still running may need the keys and the busy handles
+		volume.ops.whenIdle(func() {
+			for _, f := range busy {
+				f.fdLock.Lock()
+				volume.closeLockedFile(f, true)
+			}
+			if len(busy) > 0 {
+				volume.flushIndex()
+			}
+			volume.wipe()
+		})
+	}
+	return fileHandles, true
+}
+
+// selectBackend returns the backend called "name", which must implement the
+// algorithm used by the volume.
+func selectBackend(algo cryptocore.AEADTypeEnum, name string) (cryptocore.AEADTypeEnum, error) {
+	for _, b := range availableBackends() {
+		if b.String() == name {
+			if b.Algo != algo.Algo {
+				return algo, fmt.Errorf("backend %q does not implement %s", name, algo.Algo)
+			}
+			return b, nil
+		}
+	}
+	return algo, fmt.Errorf("unknown backend %q", name)
+}
+
+// registerNewVolume sets up the volume and assigns it a volume ID. Returns
+// -5 if a re-key is running or has been interrupted, -1 on other errors.
+func registerNewVolume(rootCipherDir string, masterkey []byte, cf *configfile.ConfFile, opts *openOptions) int {
+	rootLock, err := lockRoot(rootCipherDir, syscall.LOCK_SH)
+	if err == syscall.EWOULDBLOCK {
+		return -5
+	} else if err != nil {
+		return -1
+	}
+	if rekeyPending(rootCipherDir) {
+		if rootLock != nil {
+			rootLock.Close()
+		}
+		return -5
+	}
+	volume, err := newVolume(rootCipherDir, masterkey, cf, opts)
+	if err != nil {
+		if rootLock != nil {
+			rootLock.Close()
+		}
+		return -1
+	}
+	volume.rootLock = rootLock
+	// Volumes without index are fine
+	volume.loadIndex()
+
+	//find unused volumeID
+	c := 0
+	for {
+		// LoadOrStore so that two volumes opened concurrently can't get the
+		// same ID
+		volume.volumeID = c
+		_, loaded := OpenedVolumes.LoadOrStore(c, volume)
+		if !loaded {
+			break
+		}
+		c++
+	}
+	return volume.volumeID
+}
+
+// newVolume sets up the cryptography for the volume in "rootCipherDir"
+// without registering it. Used directly for volumes only used internally,
+// like during a re-key.
+func newVolume(rootCipherDir string, masterkey []byte, cf *configfile.ConfFile, opts *openOptions) (*Volume, error) {
 	var newVolume Volume
 
 	newVolume.plainTextNames = cf.IsFeatureFlagSet(configfile.FlagPlaintextNames)
 
 	cryptoBackend, err := cf.ContentEncryption()
 	if err != nil {
-		return -1
+		return nil, err
 	}
-	if cryptoBackend == cryptocore.BackendXChaCha20Poly1305 && stupidgcm.PreferOpenSSLXchacha20poly1305() {
+	if opts.backend != "" {
+		cryptoBackend, err = selectBackend(cryptoBackend, opts.backend)
+		if err != nil {
+			return nil, err
+		}
+	} else if cryptoBackend == cryptocore.BackendXChaCha20Poly1305 && stupidgcm.PreferOpenSSLXchacha20poly1305() {
 		cryptoBackend = cryptocore.BackendXChaCha20Poly1305OpenSSL
 	} else if cryptoBackend == cryptocore.BackendGoGCM && stupidgcm.PreferOpenSSLAES256GCM() {
 		cryptoBackend = cryptocore.BackendOpenSSL
 	}
+	newVolume.conf = cf
+	newVolume.cryptoBackend = cryptoBackend
+	newVolume.badname = opts.badname
 	newVolume.cryptoCore = cryptocore.New(masterkey, cryptoBackend, cryptoBackend.NonceSize*8, cf.IsFeatureFlagSet(configfile.FlagHKDF))
 	newVolume.contentEnc = contentenc.New(newVolume.cryptoCore, contentenc.DefaultBS)
-	var badname []string
 	newVolume.nameTransform = nametransform.New(
 		newVolume.cryptoCore.EMECipher,
 		true,
 		cf.LongNameMax,
 		cf.IsFeatureFlagSet(configfile.FlagRaw64),
-		badname,
+		opts.badname,
 		!cf.IsFeatureFlagSet(configfile.FlagDirIV),
 	)
 
@@ -97,57 +334,189 @@ func registerNewVolume(rootCipherDir string, masterkey []byte, cf *configfile.Co
 	}
 	newVolume.dirCache = dirCache{ivLen: ivLen}
 	newVolume.fileHandles = make(map[int]*File)
-
-	//find unused volumeID
-	volumeID := -1
-	c := 0
-	for volumeID == -1 {
-		_, ok := OpenedVolumes.Load(c)
-		if !ok {
-			volumeID = c
-		}
-		c++
-	}
-	OpenedVolumes.Store(volumeID, &newVolume)
-	return volumeID
+	return &newVolume, nil
 }
 
+// gcf_init opens the volume in "rootCipherDir" with "password", or with
+// "givenScryptHash" if not empty, and returns its volume ID.
+//
+// If "returnedScryptHashBuff" is not empty, the scrypt hash is copied to it.
+// Buffers of exactly ScryptHashLen bytes (see gcf_capabilities) get the hash
+// in an envelope bound to the current password, other buffers the raw hash.
+// Likewise, only a "givenScryptHash" of ScryptHashLen bytes is opened as an
+// envelope.
+//
+// Returns -1 if the config file can't be loaded (see gcf_check_config) or
+// updated, -2 if the password is wrong, -3 if the hash was returned before the
+// last password change and must be enrolled again, -4 if the config file has
+// been tampered with (its settings don't match its MAC) and -5 if a re-key of
+// the volume is running or has been interrupted, in which case gcf_rekey must
+// be called again to complete it. Raw hashes are not bound to a password, so
+// any raw hash that does not unlock the volume gets -3. Configs without MAC,
+// written by gocryptfs or older versions, are accepted unless they have been
+// migrated with gcf_migrate_config_mac.
+//
 //export gcf_init
 func gcf_init(rootCipherDir string, password, givenScryptHash, returnedScryptHashBuff []byte) int {
+	return initVolume(rootCipherDir, password, givenScryptHash, returnedScryptHashBuff, &openOptions{})
+}
+
+// gcf_init_with_options is like gcf_init but takes additional settings:
+//
+// "badnamePatterns" is a NUL-separated list of glob patterns. Ciphertext names
+// matching one of them are listed with the " GOCRYPTFS_BAD_NAME" suffix when
+// they can't be decrypted, for example ".sync-conflict-" copies created by sync
+// tools. These entries can then be opened, renamed or deleted like any other.
+// Returns -1 if a pattern is malformed.
+//
+// "backend" forces the content encryption implementation, like
+// "AES-GCM-256-Go" (see gcf_speed and gcf_capabilities). It must implement
+// the algorithm of the volume, otherwise -1 is returned. Pass an empty string
+// to let the library choose.
+//
+//export gcf_init_with_options
+func gcf_init_with_options(rootCipherDir string, password, givenScryptHash, returnedScryptHashBuff []byte, badnamePatterns string, backend string) int {
+	badname, err := parseBadnamePatterns(badnamePatterns)
+	if err != nil {
+		wipe(password)
+		return -1
+	}
+	return initVolume(rootCipherDir, password, givenScryptHash, returnedScryptHashBuff, &openOptions{
+		badname: badname,
+		backend: backend,
+	})
+}
+
+func initVolume(rootCipherDir string, password, givenScryptHash, returnedScryptHashBuff []byte, opts *openOptions) int {
 	defer wipe(password)
+	cf, masterkey, errCode := unlockMasterkey(rootCipherDir, password, givenScryptHash, returnedScryptHashBuff)
+	if errCode != 0 {
+		return errCode
+	}
+	volumeID := openUnlockedVolume(rootCipherDir, masterkey.Bytes(), cf, opts)
+	masterkey.Destroy()
+	return volumeID
+}
+
+// openUnlockedVolume registers the volume after its config file has been
+// verified by unlockMasterkey, and updates the backup of the config file.
+// Returns the volume ID or -1.
+func openUnlockedVolume(rootCipherDir string, masterkey []byte, cf *configfile.ConfFile, opts *openOptions) int {
+	// The config file is genuine, keep a backup of it. Volumes created by
+	// older versions have none.
+	if err := cf.UpdateBackup(); err != nil && !isReadOnlyErr(err) {
+		return -1
+	}
+	return registerNewVolume(rootCipherDir, masterkey, cf, opts)
+}
+
+// isReadOnlyErr returns true if "err" means that the ciphertext directory
+// can't be written to, like on read-only storage. Volumes there can still be
+// opened, their config file just stays as it is.
+func isReadOnlyErr(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM)
+}
+
+// unlockMasterkey loads the config file of the volume in "rootCipherDir" and
+// decrypts the masterkey, which the caller must Destroy(). On failure, the
+// gcf_init error code is returned. Nothing is written to the volume.
+func unlockMasterkey(rootCipherDir string, password, givenScryptHash, returnedScryptHashBuff []byte) (*configfile.ConfFile, *securemem.Buffer, int) {
+	return unlockMasterkeyNotify(rootCipherDir, password, givenScryptHash, returnedScryptHashBuff, nil)
+}
+
+// unlockMasterkeyNotify is like unlockMasterkey and reports its progress to
+// "phase", if not nil, with the unlockPhase* constants.
+func unlockMasterkeyNotify(rootCipherDir string, password, givenScryptHash, returnedScryptHashBuff []byte, phase func(int)) (*configfile.ConfFile, *securemem.Buffer, int) {
+	if phase == nil {
+		phase = func(int) {}
+	}
 	cf, err := configfile.Load(filepath.Join(rootCipherDir, configfile.ConfDefaultName))
 	if err != nil {
-		return -1
+		return nil, nil, -1
 	}
-	masterkey, err := cf.GetMasterkey(password, givenScryptHash, returnedScryptHashBuff)
+	phase(unlockPhaseKDFStarted)
+	masterkey, err := cf.GetMasterkeyNotify(password, givenScryptHash, returnedScryptHashBuff, func() {
+		phase(unlockPhaseKDFDone)
+	})
 	if err != nil {
-		return -2
+		return nil, nil, unlockErrCode(err)
 	}
+	phase(unlockPhaseConfigVerified)
 	debug.FreeOSMemory()
-	volumeID := registerNewVolume(rootCipherDir, masterkey, cf)
-	wipe(masterkey)
-	return volumeID
+	return cf, masterkey, 0
+}
+
+// unlockErrCode converts an error returned by GetMasterkey to a gcf_init
+// error code.
+func unlockErrCode(err error) int {
+	switch err {
+	case configfile.ErrStaleScryptHash:
+		return -3
+	case configfile.ErrConfigTampered:
+		return -4
+	}
+	return -2
+}
+
+// gcf_verify_password checks "password", or "givenScryptHash" if not empty,
+// against the volume in "rootCipherDir" without opening it. If the password is
+// correct and "returnedScryptHashBuff" is not empty, the scrypt hash is copied
+// to it.
+//
+// Returns 0 on success and the same error codes as gcf_init: -1 if the config
+// file can't be loaded, -2 if the password is wrong, -3 if the hash is stale,
+// -4 if the config file has been tampered with.
+//
+//export gcf_verify_password
+func gcf_verify_password(rootCipherDir string, password, givenScryptHash, returnedScryptHashBuff []byte) int {
+	defer wipe(password)
+	_, masterkey, errCode := unlockMasterkey(rootCipherDir, password, givenScryptHash, returnedScryptHashBuff)
+	if errCode != 0 {
+		return errCode
+	}
+	masterkey.Destroy()
+	return 0
 }
 
 //export gcf_close
 func gcf_close(volumeID int) {
+	gcf_close_volume(volumeID, -1, false)
+}
+
+// gcf_close_volume stops admitting new operations on the volume, waits up to
+// "timeoutMs" milliseconds (forever if negative) for the in-flight ones, then
+// flushes and closes all file handles and wipes the keys.
+//
+// If the timeout expires and "force" is false, the volume stays open and
+// false is returned. With "force", gcf_close_volume returns right away: idle
+// file handles are closed immediately, the ones a read or write is still
+// using and the keys as soon as the last in-flight operation returned.
+//
+// On success, the IDs of the file handles that were still open are returned.
+//
+// Waiting forever from a progress or walk callback of an operation on the
+// same volume would deadlock, so a negative timeout fails in that case. Use a
+// timeout with "force" there instead.
+//
+//export gcf_close_volume
+func gcf_close_volume(volumeID int, timeoutMs int, force bool) (bool, *C.int, C.int) {
 	value, ok := OpenedVolumes.Load(volumeID)
 	if !ok {
-		return
+		return false, nil, 0
 	}
 	volume := value.(*Volume)
-	volume.cryptoCore.Wipe()
-	volume.handlesLock.RLock()
-	fileHandles := make([]int, 0, len(volume.fileHandles))
-	for i := range volume.fileHandles {
-		fileHandles = append(fileHandles, i)
+	fileHandles, ok := volume.close(time.Duration(timeoutMs)*time.Millisecond, force)
+	if !ok {
+		return false, nil, 0
 	}
-	volume.handlesLock.RUnlock()
+	if len(fileHandles) == 0 {
+		return true, nil, 0
+	}
+	handles := make([]uint32, len(fileHandles))
 	for i := range fileHandles {
-		gcf_close_file(volumeID, i)
+		handles[i] = uint32(fileHandles[i])
 	}
-	volume.dirCache.Clear()
-	OpenedVolumes.Delete(volumeID)
+	return true, cIntArray(handles), (C.int)(len(handles))
 }
 
 //export gcf_is_closed
@@ -158,17 +527,44 @@ func gcf_is_closed(volumeID int) bool {
 
 //export gcf_change_password
 func gcf_change_password(rootCipherDir string, oldPassword, givenScryptHash, newPassword, returnedScryptHashBuff []byte) bool {
+	return changePassword(rootCipherDir, oldPassword, givenScryptHash, newPassword, 0, returnedScryptHashBuff)
+}
+
+// gcf_change_password_with_cost works like gcf_change_password but also sets
+// the scrypt cost parameter of the new password to "logN" (see
+// gcf_calibrate_kdf). 0 keeps the current value. Fails if "logN" is out of
+// the accepted range.
+//
+//export gcf_change_password_with_cost
+func gcf_change_password_with_cost(rootCipherDir string, oldPassword, givenScryptHash, newPassword []byte, logN int, returnedScryptHashBuff []byte) bool {
+	if logN != 0 && !configfile.ValidScryptLogN(logN) {
+		wipe(newPassword)
+		wipe(oldPassword)
+		wipe(givenScryptHash)
+		return false
+	}
+	return changePassword(rootCipherDir, oldPassword, givenScryptHash, newPassword, logN, returnedScryptHashBuff)
+}
+
+// changePassword re-encrypts the masterkey with "newPassword", using the
+// scrypt cost "logN", or the current one if "logN" is 0.
+func changePassword(rootCipherDir string, oldPassword, givenScryptHash, newPassword []byte, logN int, returnedScryptHashBuff []byte) bool {
 	success := false
 	cf, err := configfile.Load(filepath.Join(rootCipherDir, configfile.ConfDefaultName))
-	if err == nil {
+	if err == nil && !rekeyPending(rootCipherDir) {
 		masterkey, err := cf.GetMasterkey(oldPassword, givenScryptHash, nil)
 		if err == nil {
-			logN := cf.ScryptObject.LogN()
-			scryptHash := cf.EncryptKey(masterkey, newPassword, logN, len(returnedScryptHashBuff) > 0)
-			wipe(masterkey)
-			for i := range scryptHash {
-				returnedScryptHashBuff[i] = scryptHash[i]
-				scryptHash[i] = 0
+			if logN == 0 {
+				logN = cf.ScryptObject.LogN()
+			}
+			scryptHash := cf.EncryptKey(masterkey.Bytes(), newPassword, logN, len(returnedScryptHashBuff) > 0)
+			if cf.HasMAC() {
+				cf.SetMAC(masterkey.Bytes())
+			}
+			masterkey.Destroy()
+			if scryptHash != nil {
+				cf.CopyScryptHash(returnedScryptHashBuff, scryptHash.Bytes())
+				scryptHash.Destroy()
 			}
 			success = errToBool(cf.WriteFile())
 		}
@@ -179,6 +575,14 @@ func gcf_change_password(rootCipherDir string, oldPassword, givenScryptHash, new
 	return success
 }
 
+// gcf_create_volume creates a new volume in "rootCipherDir". "xchacha"
+// selects the content encryption: 1 for XChaCha20-Poly1305, 0 for AES-GCM,
+// any other value picks XChaCha20-Poly1305 if the CPU has no AES
+// acceleration.
+//
+// The config file of new volumes carries a MAC that gcf_init requires (see
+// gcf_migrate_config_mac), so they can't be mounted by gocryptfs.
+//
 //export gcf_create_volume
 func gcf_create_volume(rootCipherDir string, password []byte, plaintextNames bool, xchacha int8, logN int, creator string, returnedScryptHashBuff []byte) bool {
 	var useXChaCha bool
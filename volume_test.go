@@ -0,0 +1,176 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"libgocryptfs/v2/internal/configfile"
+)
+
+const testPassword = "test"
+
+// createTestVolume creates a volume with the lowest scrypt cost in a new
+// temporary directory and returns its path.
+func createTestVolume(t *testing.T, plaintextNames bool) string {
+	t.Helper()
+	dir := t.TempDir()
+	if !gcf_create_volume(dir, []byte(testPassword), plaintextNames, 0, 10, "test", nil) {
+		t.Fatal("gcf_create_volume failed")
+	}
+	return dir
+}
+
+// openTestVolume opens the volume in "dir" and closes it at the end of the
+// test.
+func openTestVolume(t *testing.T, dir string) int {
+	t.Helper()
+	volumeID := gcf_init(dir, []byte(testPassword), nil, nil)
+	if volumeID < 0 {
+		t.Fatalf("gcf_init returned %d", volumeID)
+	}
+	t.Cleanup(func() { gcf_close_volume(volumeID, 1000, true) })
+	return volumeID
+}
+
+// newTestVolume creates and opens a volume.
+func newTestVolume(t *testing.T) (string, int) {
+	t.Helper()
+	dir := createTestVolume(t, false)
+	return dir, openTestVolume(t, dir)
+}
+
+// writeTestFile creates "path" with "content".
+func writeTestFile(t *testing.T, volumeID int, path string, content []byte) {
+	t.Helper()
+	handleID := gcf_open_write_mode(volumeID, path, 0600)
+	if handleID < 0 {
+		t.Fatalf("can't create %q", path)
+	}
+	defer gcf_close_file(volumeID, handleID)
+	if len(content) == 0 {
+		return
+	}
+	if n := gcf_write_file(volumeID, handleID, 0, content); int(n) != len(content) {
+		t.Fatalf("wrote %d bytes to %q instead of %d", n, path, len(content))
+	}
+}
+
+// readTestFile returns the content of "path", at most "max" bytes.
+func readTestFile(t *testing.T, volumeID int, path string, max int) []byte {
+	t.Helper()
+	handleID := gcf_open_read_mode(volumeID, path)
+	if handleID < 0 {
+		t.Fatalf("can't open %q", path)
+	}
+	defer gcf_close_file(volumeID, handleID)
+	buf := make([]byte, max)
+	n := gcf_read_file(volumeID, handleID, 0, buf)
+	return buf[:n]
+}
+
+// getVolume returns the opened volume "volumeID".
+func getVolume(t *testing.T, volumeID int) *Volume {
+	t.Helper()
+	value, ok := OpenedVolumes.Load(volumeID)
+	if !ok {
+		t.Fatalf("volume %d is not open", volumeID)
+	}
+	return value.(*Volume)
+}
+
+func TestCloseVolumeWaits(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	volume, _ := acquireVolume(volumeID)
+	if ok, _, _ := gcf_close_volume(volumeID, 50, false); ok {
+		t.Fatal("closed with an operation in flight")
+	}
+	if gcf_is_closed(volumeID) {
+		t.Fatal("volume unregistered after a failed close")
+	}
+	// The failed close admits new operations again
+	if !gcf_mkdir(volumeID, "/d", 0700) {
+		t.Fatal("mkdir after a failed close")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		volume.release()
+	}()
+	if ok, _, _ := gcf_close_volume(volumeID, -1, false); !ok {
+		t.Fatal("close failed")
+	}
+	if !gcf_is_closed(volumeID) {
+		t.Fatal("volume still registered")
+	}
+	if _, ok := acquireVolume(volumeID); ok {
+		t.Fatal("operation admitted on a closed volume")
+	}
+}
+
+func TestCloseVolumeReturnsHandles(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	gcf_open_write_mode(volumeID, "/f", 0600)
+	ok, handles, n := gcf_close_volume(volumeID, 1000, false)
+	if !ok || n != 1 || handles == nil {
+		t.Fatalf("got %v, %d handles", ok, n)
+	}
+	if gcf_open_read_mode(volumeID, "/f") >= 0 {
+		t.Fatal("opened a file on a closed volume")
+	}
+}
+
+func TestCloseVolumeForce(t *testing.T) {
+	_, volumeID := newTestVolume(t)
+	handleID := gcf_open_write_mode(volumeID, "/f", 0600)
+	volume, _ := acquireVolume(volumeID)
+	// A read in progress on the handle
+	volume.handlesLock.RLock()
+	f := volume.fileHandles[handleID]
+	volume.handlesLock.RUnlock()
+	f.fdLock.RLock()
+
+	start := time.Now()
+	ok, _, n := gcf_close_volume(volumeID, 10, true)
+	if !ok || n != 1 {
+		t.Fatalf("got %v, %d handles", ok, n)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("forced close took %v", d)
+	}
+	if !gcf_is_closed(volumeID) {
+		t.Fatal("volume still registered")
+	}
+	// The busy handle and the keys are kept until the read returns
+	if f.fd.Fd() == ^uintptr(0) {
+		t.Fatal("fd closed during a read")
+	}
+	f.fdLock.RUnlock()
+	volume.release()
+	for i := 0; f.fd.Fd() != ^uintptr(0); i++ {
+		if i == 100 {
+			t.Fatal("fd not closed after the read returned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Hashes stop working once the password changed, raw ones included.
+func TestInitStaleHash(t *testing.T) {
+	dir := createTestVolume(t, false)
+	raw := make([]byte, 32)
+	envelope := make([]byte, configfile.ScryptHashEnvelopeLen)
+	if code := gcf_verify_password(dir, []byte(testPassword), nil, raw); code != 0 {
+		t.Fatalf("gcf_verify_password returned %d", code)
+	}
+	gcf_verify_password(dir, []byte(testPassword), nil, envelope)
+	if code := gcf_verify_password(dir, []byte("wrong"), nil, nil); code != -2 {
+		t.Errorf("wrong password: %d", code)
+	}
+	if !gcf_change_password_with_cost(dir, []byte(testPassword), nil, []byte("new"), 10, nil) {
+		t.Fatal("gcf_change_password failed")
+	}
+	for _, hash := range [][]byte{raw, envelope} {
+		if code := gcf_init(dir, nil, hash, nil); code != -3 {
+			t.Errorf("%d byte hash: gcf_init returned %d", len(hash), code)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"libgocryptfs/v2/internal/syscallcompat"
+)
+
+// walkEntry is an entry found by walkTree.
+type walkEntry struct {
+	dirEntry
+	// path is the plaintext path of the entry
+	path string
+	// dirfd is the ciphertext directory containing the entry. It is only
+	// valid during the callback.
+	dirfd int
+	// err is set for directories that could not be opened or read. Only
+	// passed to the "leave" callback.
+	err error
+}
+
+func (e *walkEntry) isDir() bool {
+	return e.mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// entryAttrs returns the plaintext size and the modification time of the entry.
+func (volume *Volume) entryAttrs(e *walkEntry) (size uint64, mtime uint64, err error) {
+	st, err := syscallcompat.Fstatat2(e.dirfd, e.cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return 0, 0, err
+	}
+	return volume.translateSize(e.dirfd, e.cName, st), uint64(st.Mtim.Sec), nil
+}
+
+// errSkipDir can be returned by the "enter" callback of walkTree to skip the
+// content of a directory.
+var errSkipDir = errors.New("skip this directory")
+
+// walkFunc is called by walkTree. Returning an error other than errSkipDir
+// stops the walk.
+type walkFunc func(e *walkEntry) error
+
+// walkTree walks the directory tree below "dirPath", depth-first. "enter" is
+// called for every entry before the content of directories, "leave" (may be
+// nil) for every directory after its content.
+//
+// Subdirectories are opened relative to their parent and the DirIVs are read
+// once per directory, so that walking does not go through prepareAtSyscall
+// and the dirCache for every entry.
+func (volume *Volume) walkTree(dirPath string, enter, leave walkFunc) error {
+	parentDirFd, cDirName, err := volume.prepareAtSyscallMyself(dirPath)
+	if err != nil {
+		return err
+	}
+	fd, err := syscallcompat.Openat(parentDirFd, cDirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	syscall.Close(parentDirFd)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if dirPath == "" {
+		dirPath = "/"
+	}
+	entries, err := volume.readDirAt(fd, dirPath == "/", false)
+	if err != nil {
+		return err
+	}
+	return volume.walkEntries(fd, dirPath, entries, enter, leave)
+}
+
+// walkEntries visits "entries", read from the directory "fd".
+func (volume *Volume) walkEntries(fd int, dirPath string, entries []dirEntry, enter, leave walkFunc) error {
+	for i := range entries {
+		e := &walkEntry{
+			dirEntry: entries[i],
+			path:     path.Join(dirPath, entries[i].name),
+			dirfd:    fd,
+		}
+		err := enter(e)
+		if err == errSkipDir {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !e.isDir() {
+			continue
+		}
+		subfd, err := syscallcompat.Openat(fd, e.cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			e.err = err
+		} else {
+			var children []dirEntry
+			children, e.err = volume.readDirAt(subfd, false, false)
+			if e.err == nil {
+				err = volume.walkEntries(subfd, e.path, children, enter, leave)
+			}
+			syscall.Close(subfd)
+			if err != nil {
+				return err
+			}
+		}
+		if leave != nil {
+			if err = leave(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}